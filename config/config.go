@@ -1,7 +1,11 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"log"
 	"os"
+	"time"
 
 	"github.com/go-yaml/yaml"
 	"github.com/google/uuid"
@@ -16,10 +20,41 @@ type Config struct {
 	TrustedProxies []string          `yaml:"trusted_proxies"`
 	RepoURL        string            `yaml:"repo_url"`
 	RequireInvite  bool              `yaml:"require_invite"`
-	InviteCode     string            `yaml:"invite_code"`
-	AnnilToken     []AnnilToken      `yaml:"annil_token"`
-	Debug          DebugConfig       `yaml:"debug"`
-	EnableMeta     bool              `yaml:"enable_meta"`
+	// Deprecated: moved into an invite of the first admin on startup
+	InviteCode string `yaml:"invite_code"`
+	// Uses of the invite the invite code is moved into
+	InviteCodeMaxUses int `yaml:"invite_code_max_uses"`
+	InviteQuota       int `yaml:"invite_quota"`
+	// Maximum concurrent sessions per user, 0 for unlimited
+	MaxSessions int `yaml:"max_sessions"`
+	// Sessions unused for longer than this expire, 0 to disable
+	SessionIdleTimeout time.Duration `yaml:"session_idle_timeout"`
+	// Sessions expire this long after login regardless of activity, 0 to disable
+	SessionMaxAge time.Duration    `yaml:"session_max_age"`
+	LoginLimit    LoginLimitConfig `yaml:"login_limit"`
+	WebAuthn      WebAuthnConfig   `yaml:"webauthn"`
+	OIDC          []OIDCProvider   `yaml:"oidc"`
+	// Only allow login through passkeys and oidc providers
+	DisablePasswordLogin bool         `yaml:"disable_password_login"`
+	AnnilToken           []AnnilToken `yaml:"annil_token"`
+	Debug                DebugConfig  `yaml:"debug"`
+	EnableMeta           bool         `yaml:"enable_meta"`
+	SiteURL              string       `yaml:"site_url"`
+	Secret               string       `yaml:"secret"`
+	SMTP                 SMTPConfig   `yaml:"smtp"`
+	// Only takes effect when smtp is enabled
+	RequireEmailVerification bool         `yaml:"require_email_verification"`
+	Cookie                   CookieConfig `yaml:"cookie"`
+	// Origins besides site_url allowed to make cookie authenticated requests
+	TrustedOrigins []string       `yaml:"trusted_origins"`
+	Password       PasswordConfig `yaml:"password"`
+	// Base64 encoded 32 byte key sealing 2fa secrets and annil tokens,
+	// overridden by the ANNIV_ENCRYPTION_KEY environment variable
+	EncryptionKey string `yaml:"encryption_key"`
+	// Previous keys still needed to open values until they are resealed
+	OldEncryptionKeys []string           `yaml:"old_encryption_keys"`
+	Avatar            AvatarConfig       `yaml:"avatar"`
+	TokenRenewal      TokenRenewalConfig `yaml:"token_renewal"`
 }
 
 type AnnilToken struct {
@@ -31,20 +66,122 @@ type AnnilToken struct {
 	AllowShare   bool   `yaml:"allow_share"`
 }
 
+type LoginLimitConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Failed attempts allowed per account before it is locked
+	AccountAttempts int `yaml:"account_attempts"`
+	// Failed attempts allowed per ip before it is locked
+	IPAttempts int `yaml:"ip_attempts"`
+	// Lockout after the first exceeding failure, doubled on each further one
+	BaseLockout time.Duration `yaml:"base_lockout"`
+	MaxLockout  time.Duration `yaml:"max_lockout"`
+	// Failures are forgotten after this long without another failure
+	ResetAfter time.Duration `yaml:"reset_after"`
+}
+
+type WebAuthnConfig struct {
+	// Off by default, since passkeys are bound to the rp id and only work
+	// once site_url or rp_id match the origin users actually visit
+	Enabled bool `yaml:"enabled"`
+	// Defaults to the host of site_url
+	RPID string `yaml:"rp_id"`
+	// Defaults to site_url
+	RPOrigins []string `yaml:"rp_origins"`
+}
+
+type OIDCProvider struct {
+	// Identifies the provider in urls, must not change once users have linked it
+	Name         string   `yaml:"name"`
+	DisplayName  string   `yaml:"display_name"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+	// Create accounts for identities not linked to any user
+	AutoRegister bool `yaml:"auto_register"`
+}
+
+type PasswordConfig struct {
+	// Either argon2id or bcrypt, stored hashes of the other kind are
+	// rehashed on login
+	Algorithm  string       `yaml:"algorithm"`
+	BcryptCost int          `yaml:"bcrypt_cost"`
+	Argon2     Argon2Config `yaml:"argon2"`
+	MinLength  int          `yaml:"min_length"`
+	// File of breached passwords, one plain password or sha1 hash per line
+	BreachedList string `yaml:"breached_list"`
+}
+
+type Argon2Config struct {
+	// Memory in KiB
+	Memory      uint32 `yaml:"memory"`
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+	SaltLength  uint32 `yaml:"salt_length"`
+	KeyLength   uint32 `yaml:"key_length"`
+}
+
+type AvatarConfig struct {
+	// Maximum upload size in bytes
+	MaxSize int64 `yaml:"max_size"`
+	// Blob store keeping the resized images, only local is built in
+	Storage string `yaml:"storage"`
+	// Directory of the local blob store
+	Path string `yaml:"path"`
+}
+
+type TokenRenewalConfig struct {
+	// Periodically re-sign controlled annil tokens in the background
+	Enabled  bool          `yaml:"enabled"`
+	Interval time.Duration `yaml:"interval"`
+	// Tokens expiring within this period are renewed
+	RenewBefore time.Duration `yaml:"renew_before"`
+}
+
+type CookieConfig struct {
+	Secure bool `yaml:"secure"`
+	// One of lax, strict or none
+	SameSite string `yaml:"same_site"`
+	Domain   string `yaml:"domain"`
+	Path     string `yaml:"path"`
+}
+
+type SMTPConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
 type DebugConfig struct {
 	Enabled        bool   `yaml:"enabled"`
 	MemProfilePath string `yaml:"mem_profile_path"`
 }
 
 var Cfg = Config{
-	SiteName:       "Anniv",
-	Description:    "",
-	Listen:         ":8080",
-	Enforce2FA:     false,
-	TrustedProxies: []string{"127.0.0.1/32"},
-	RepoURL:        "https://github.com/ProjectAnni/repo.git",
-	RequireInvite:  false,
-	InviteCode:     uuid.NewString(),
+	SiteName:           "Anniv",
+	Description:        "",
+	Listen:             ":8080",
+	Enforce2FA:         false,
+	TrustedProxies:     []string{"127.0.0.1/32"},
+	RepoURL:            "https://github.com/ProjectAnni/repo.git",
+	RequireInvite:      false,
+	InviteCode:         "",
+	InviteCodeMaxUses:  10,
+	InviteQuota:        0,
+	MaxSessions:        0,
+	SessionIdleTimeout: 7 * 24 * time.Hour,
+	SessionMaxAge:      30 * 24 * time.Hour,
+	LoginLimit: LoginLimitConfig{
+		Enabled:         true,
+		AccountAttempts: 5,
+		IPAttempts:      20,
+		BaseLockout:     time.Minute,
+		MaxLockout:      time.Hour,
+		ResetAfter:      24 * time.Hour,
+	},
 	AnnilToken: []AnnilToken{
 		{
 			Enabled:    false,
@@ -59,12 +196,64 @@ var Cfg = Config{
 		MemProfilePath: "mem.prof",
 	},
 	EnableMeta: true,
+	SiteURL:    "http://localhost:8080",
+	Secret:     "",
+	WebAuthn: WebAuthnConfig{
+		Enabled: false,
+	},
+	OIDC:                 []OIDCProvider{},
+	DisablePasswordLogin: false,
+	Cookie: CookieConfig{
+		Secure:   false,
+		SameSite: "lax",
+		Domain:   "",
+		Path:     "/",
+	},
+	TrustedOrigins: []string{},
+	Password: PasswordConfig{
+		Algorithm:  "argon2id",
+		BcryptCost: 10,
+		Argon2: Argon2Config{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		MinLength:    8,
+		BreachedList: "",
+	},
+	EncryptionKey:     "",
+	OldEncryptionKeys: []string{},
+	Avatar: AvatarConfig{
+		MaxSize: 5 << 20,
+		Storage: "local",
+		Path:    "./tmp/avatars",
+	},
+	TokenRenewal: TokenRenewalConfig{
+		Enabled:     true,
+		Interval:    6 * time.Hour,
+		RenewBefore: 7 * 24 * time.Hour,
+	},
+	SMTP: SMTPConfig{
+		Enabled: false,
+		Host:    "localhost",
+		Port:    25,
+		From:    "anniv@localhost",
+	},
+	RequireEmailVerification: false,
 }
 
 func Load() error {
 	f, err := os.Open(os.Getenv("CONF"))
 	if err != nil {
 		if os.IsNotExist(err) {
+			Cfg.Secret = uuid.NewString()
+			key := make([]byte, 32)
+			if _, err := rand.Read(key); err != nil {
+				return err
+			}
+			Cfg.EncryptionKey = base64.StdEncoding.EncodeToString(key)
 			if err := Save(); err != nil {
 				return err
 			}
@@ -78,7 +267,17 @@ func Load() error {
 	}
 	defer f.Close()
 	err = yaml.NewDecoder(f).Decode(&Cfg)
-	return err
+	if err != nil {
+		return err
+	}
+	if Cfg.Secret == "" {
+		log.Println("No secret configured, signed links will be invalidated on restart.")
+		Cfg.Secret = uuid.NewString()
+	}
+	if key := os.Getenv("ANNIV_ENCRYPTION_KEY"); key != "" {
+		Cfg.EncryptionKey = key
+	}
+	return nil
 }
 
 func Save() error {
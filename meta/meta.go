@@ -198,6 +198,7 @@ func readAlbums(p string) ([]AlbumDetails, error) {
 			disc.Tags = toArray(discTags)
 		}
 		album.Tags = toArray(albumTags)
+		album.ownTags = record.Album.Tags
 
 		ret = append(ret, album)
 	}
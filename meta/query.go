@@ -0,0 +1,413 @@
+package meta
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+var (
+	ErrEmptyQuery       = errors.New("empty query")
+	ErrUnbalancedParens = errors.New("unbalanced parentheses")
+	ErrUnclosedQuote    = errors.New("unclosed quote")
+	ErrMissingOperand   = errors.New("missing operand")
+	ErrInvalidRange     = errors.New("invalid range")
+)
+
+type fieldKind int
+
+const (
+	textField fieldKind = iota
+	keywordField
+	numericField
+	dateField
+)
+
+// searchFields maps the field names accepted in queries to index fields.
+var searchFields = map[string]struct {
+	name string
+	kind fieldKind
+}{
+	"title":   {"title", textField},
+	"artist":  {"artist", textField},
+	"album":   {"album", textField},
+	"catalog": {"catalog", keywordField},
+	"type":    {"type", keywordField},
+	"tag":     {"tag", keywordField},
+	"tags":    {"tag", keywordField},
+	"date":    {"date", dateField},
+	"year":    {"year", numericField},
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind   tokenKind
+	field  string
+	value  string
+	phrase bool
+}
+
+// ParseQuery parses a search query such as
+//
+//	artist:ClariS year:>=2013 (type:single OR type:album) -tag:"series:Madoka" "connect"
+//
+// into a bleve query. Terms are joined with AND unless separated by OR,
+// and may be negated with NOT or a leading '-'.
+func ParseQuery(q string) (query.Query, error) {
+	tokens, err := tokenize(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, ErrEmptyQuery
+	}
+	p := queryParser{tokens: tokens}
+	res, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, ErrUnbalancedParens
+	}
+	return wrapNegation(res), nil
+}
+
+func tokenize(q string) ([]token, error) {
+	var res []token
+	r := []rune(q)
+	i := 0
+	for i < len(r) {
+		c := r[i]
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(':
+			res = append(res, token{kind: tokLParen})
+			i++
+		case c == ')':
+			res = append(res, token{kind: tokRParen})
+			i++
+		case c == '-' && i+1 < len(r) && !unicode.IsSpace(r[i+1]) && (i == 0 || !isWordRune(r[i-1])):
+			res = append(res, token{kind: tokNot})
+			i++
+		default:
+			start := i
+			field := ""
+			colon := false
+			for i < len(r) && isWordRune(r[i]) && r[i] != '"' {
+				if r[i] == ':' && !colon {
+					colon = true
+					name := strings.ToLower(string(r[start:i]))
+					if _, ok := searchFields[name]; ok {
+						field = name
+						start = i + 1
+					}
+				}
+				i++
+			}
+			if i < len(r) && r[i] == '"' && i == start {
+				end := i + 1
+				for end < len(r) && r[end] != '"' {
+					end++
+				}
+				if end >= len(r) {
+					return nil, ErrUnclosedQuote
+				}
+				res = append(res, token{kind: tokWord, field: field, value: string(r[i+1 : end]), phrase: true})
+				i = end + 1
+				continue
+			}
+			if i < len(r) && r[i] == '"' {
+				// quote in the middle of a word is treated literally
+				i++
+				for i < len(r) && isWordRune(r[i]) {
+					i++
+				}
+			}
+			word := string(r[start:i])
+			if field == "" {
+				switch word {
+				case "AND":
+					res = append(res, token{kind: tokAnd})
+					continue
+				case "OR":
+					res = append(res, token{kind: tokOr})
+					continue
+				case "NOT":
+					res = append(res, token{kind: tokNot})
+					continue
+				}
+			}
+			if word == "" {
+				// a bare "field:" matches nothing meaningful, skip it
+				continue
+			}
+			res = append(res, token{kind: tokWord, field: field, value: word})
+		}
+	}
+	return res, nil
+}
+
+func isWordRune(c rune) bool {
+	return !unicode.IsSpace(c) && c != '(' && c != ')'
+}
+
+type queryParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *queryParser) peek() *token {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *queryParser) parseOr() (query.Query, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	clauses := []query.Query{first}
+	for {
+		t := p.peek()
+		if t == nil || t.kind != tokOr {
+			break
+		}
+		p.pos++
+		next, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, next)
+	}
+	if len(clauses) == 1 {
+		return first, nil
+	}
+	for idx := range clauses {
+		clauses[idx] = wrapNegation(clauses[idx])
+	}
+	return bleve.NewDisjunctionQuery(clauses...), nil
+}
+
+func (p *queryParser) parseAnd() (query.Query, error) {
+	var must, mustNot []query.Query
+	for {
+		t := p.peek()
+		if t == nil || t.kind == tokOr || t.kind == tokRParen {
+			break
+		}
+		if t.kind == tokAnd {
+			p.pos++
+			continue
+		}
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := q.(*negatedQuery); ok {
+			mustNot = append(mustNot, n.Query)
+		} else {
+			must = append(must, q)
+		}
+	}
+	if len(must) == 0 && len(mustNot) == 0 {
+		return nil, ErrMissingOperand
+	}
+	if len(mustNot) == 0 && len(must) == 1 {
+		return must[0], nil
+	}
+	if len(must) == 0 && len(mustNot) == 1 {
+		return &negatedQuery{mustNot[0]}, nil
+	}
+	if len(must) == 0 {
+		return &negatedQuery{bleve.NewDisjunctionQuery(mustNot...)}, nil
+	}
+	b := bleve.NewBooleanQuery()
+	b.AddMust(must...)
+	b.AddMustNot(mustNot...)
+	return b, nil
+}
+
+func (p *queryParser) parseUnary() (query.Query, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, ErrMissingOperand
+	}
+	switch t.kind {
+	case tokNot:
+		p.pos++
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := q.(*negatedQuery); ok {
+			return n.Query, nil
+		}
+		return &negatedQuery{q}, nil
+	case tokLParen:
+		p.pos++
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t == nil || t.kind != tokRParen {
+			return nil, ErrUnbalancedParens
+		}
+		p.pos++
+		return q, nil
+	case tokWord:
+		p.pos++
+		return termQuery(*t)
+	case tokRParen:
+		return nil, ErrUnbalancedParens
+	default:
+		return nil, ErrMissingOperand
+	}
+}
+
+// negatedQuery marks a clause that must not match. It is resolved by
+// the enclosing conjunction, or by wrapNegation at the top level.
+type negatedQuery struct {
+	query.Query
+}
+
+func wrapNegation(q query.Query) query.Query {
+	n, ok := q.(*negatedQuery)
+	if !ok {
+		return q
+	}
+	b := bleve.NewBooleanQuery()
+	b.AddMust(bleve.NewMatchAllQuery())
+	b.AddMustNot(n.Query)
+	return b
+}
+
+func termQuery(t token) (query.Query, error) {
+	if t.field == "" {
+		if t.phrase {
+			return bleve.NewMatchPhraseQuery(t.value), nil
+		}
+		return bleve.NewMatchQuery(t.value), nil
+	}
+	f := searchFields[t.field]
+	switch f.kind {
+	case numericField:
+		min, max, minInclusive, maxInclusive, err := parseRange(t.value, func(s string) (string, error) {
+			_, err := strconv.ParseFloat(s, 64)
+			return s, err
+		})
+		if err != nil {
+			return nil, err
+		}
+		var minVal, maxVal *float64
+		if min != "" {
+			v, _ := strconv.ParseFloat(min, 64)
+			minVal = &v
+		}
+		if max != "" {
+			v, _ := strconv.ParseFloat(max, 64)
+			maxVal = &v
+		}
+		q := bleve.NewNumericRangeInclusiveQuery(minVal, maxVal, &minInclusive, &maxInclusive)
+		q.SetField(f.name)
+		return q, nil
+	case dateField:
+		if !isRange(t.value) {
+			q := bleve.NewPrefixQuery(strings.ToLower(t.value))
+			q.SetField(f.name)
+			return q, nil
+		}
+		min, max, minInclusive, maxInclusive, err := parseRange(t.value, func(s string) (string, error) {
+			return strings.ToLower(s), nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if max != "" && maxInclusive {
+			// dates are compared as strings, so an inclusive upper bound
+			// like 2013-06 has to cover 2013-06-30 as well
+			max += "~"
+		}
+		q := bleve.NewTermRangeInclusiveQuery(min, max, &minInclusive, &maxInclusive)
+		q.SetField(f.name)
+		return q, nil
+	case keywordField:
+		if f.name == "tag" {
+			if typ, _ := ParseTagStr(t.value); typ == nil {
+				// without a type, match the tag by any of its names
+				q := bleve.NewMatchPhraseQuery(t.value)
+				q.SetField("tag_name")
+				return q, nil
+			}
+		}
+		q := bleve.NewMatchQuery(t.value)
+		q.SetField(f.name)
+		return q, nil
+	default:
+		if t.phrase {
+			q := bleve.NewMatchPhraseQuery(t.value)
+			q.SetField(f.name)
+			return q, nil
+		}
+		q := bleve.NewMatchQuery(t.value)
+		q.SetField(f.name)
+		return q, nil
+	}
+}
+
+func isRange(v string) bool {
+	return strings.HasPrefix(v, ">") || strings.HasPrefix(v, "<") || strings.Contains(v, "..")
+}
+
+// parseRange accepts "v", ">v", ">=v", "<v", "<=v" and "a..b", where
+// either side of ".." may be omitted.
+func parseRange(v string, check func(string) (string, error)) (min, max string, minInclusive, maxInclusive bool, err error) {
+	minInclusive, maxInclusive = true, true
+	switch {
+	case strings.HasPrefix(v, ">="):
+		min = v[2:]
+	case strings.HasPrefix(v, ">"):
+		min = v[1:]
+		minInclusive = false
+	case strings.HasPrefix(v, "<="):
+		max = v[2:]
+	case strings.HasPrefix(v, "<"):
+		max = v[1:]
+		maxInclusive = false
+	case strings.Contains(v, ".."):
+		idx := strings.Index(v, "..")
+		min, max = v[:idx], v[idx+2:]
+	default:
+		min, max = v, v
+	}
+	if min == "" && max == "" {
+		return "", "", false, false, ErrInvalidRange
+	}
+	if min != "" {
+		if min, err = check(min); err != nil {
+			return "", "", false, false, ErrInvalidRange
+		}
+	}
+	if max != "" {
+		if max, err = check(max); err != nil {
+			return "", "", false, false, ErrInvalidRange
+		}
+	}
+	return
+}
@@ -0,0 +1,164 @@
+package meta
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []token
+	}{
+		{"connect", []token{{kind: tokWord, value: "connect"}}},
+		{"artist:ClariS", []token{{kind: tokWord, field: "artist", value: "ClariS"}}},
+		{"ARTIST:ClariS", []token{{kind: tokWord, field: "artist", value: "ClariS"}}},
+		{"foo:bar", []token{{kind: tokWord, value: "foo:bar"}}},
+		{`tag:"series:Madoka"`, []token{{kind: tokWord, field: "tag", value: "series:Madoka", phrase: true}}},
+		{`"magia record"`, []token{{kind: tokWord, value: "magia record", phrase: true}}},
+		{`a"b`, []token{{kind: tokWord, value: `a"b`}}},
+		{"-tag:x", []token{{kind: tokNot}, {kind: tokWord, field: "tag", value: "x"}}},
+		{"a-b", []token{{kind: tokWord, value: "a-b"}}},
+		{"- a", []token{{kind: tokWord, value: "-"}, {kind: tokWord, value: "a"}}},
+		{"(a OR b) AND NOT c", []token{
+			{kind: tokLParen},
+			{kind: tokWord, value: "a"},
+			{kind: tokOr},
+			{kind: tokWord, value: "b"},
+			{kind: tokRParen},
+			{kind: tokAnd},
+			{kind: tokNot},
+			{kind: tokWord, value: "c"},
+		}},
+		{"title:OR", []token{{kind: tokWord, field: "title", value: "OR"}}},
+		{"title: a", []token{{kind: tokWord, value: "a"}}},
+		{"  ", nil},
+	}
+	for _, tt := range tests {
+		got, err := tokenize(tt.in)
+		if err != nil {
+			t.Errorf("tokenize(%q) error: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenize(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error
+	}{
+		{"", ErrEmptyQuery},
+		{"   ", ErrEmptyQuery},
+		{"(a", ErrUnbalancedParens},
+		{"a)", ErrUnbalancedParens},
+		{"()", ErrMissingOperand},
+		{`"abc`, ErrUnclosedQuote},
+		{"a OR", ErrMissingOperand},
+		{"OR a", ErrMissingOperand},
+		{"NOT", ErrMissingOperand},
+		{"year:abc", ErrInvalidRange},
+		{"year:..", ErrInvalidRange},
+		{"year:>=", ErrInvalidRange},
+		{"a", nil},
+		{"artist:ClariS year:>=2013 (type:single OR type:album) -tag:\"series:Madoka\" \"connect\"", nil},
+		{"date:2013-06..2014", nil},
+	}
+	for _, tt := range tests {
+		_, err := ParseQuery(tt.in)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("ParseQuery(%q) error = %v, want %v", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestParseQueryStructure(t *testing.T) {
+	tests := []struct {
+		in   string
+		want reflect.Type
+	}{
+		{"a", reflect.TypeOf(&query.MatchQuery{})},
+		{`"a b"`, reflect.TypeOf(&query.MatchPhraseQuery{})},
+		{"a b", reflect.TypeOf(&query.BooleanQuery{})},
+		{"a OR b", reflect.TypeOf(&query.DisjunctionQuery{})},
+		{"-a", reflect.TypeOf(&query.BooleanQuery{})},
+		{"NOT NOT a", reflect.TypeOf(&query.MatchQuery{})},
+		{"year:2013", reflect.TypeOf(&query.NumericRangeQuery{})},
+		{"date:2013", reflect.TypeOf(&query.PrefixQuery{})},
+		{"date:>2013", reflect.TypeOf(&query.TermRangeQuery{})},
+		{"tag:Madoka", reflect.TypeOf(&query.MatchPhraseQuery{})},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuery(tt.in)
+		if err != nil {
+			t.Errorf("ParseQuery(%q) error: %v", tt.in, err)
+			continue
+		}
+		if reflect.TypeOf(got) != tt.want {
+			t.Errorf("ParseQuery(%q) = %T, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueryNegation(t *testing.T) {
+	// a negated term alone must still match everything else
+	q, err := ParseQuery("-tag:x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := q.(*query.BooleanQuery)
+	if !ok {
+		t.Fatalf("got %T, want *query.BooleanQuery", q)
+	}
+	must, ok := b.Must.(*query.ConjunctionQuery)
+	if !ok || len(must.Conjuncts) != 1 {
+		t.Fatalf("got must %#v, want a single match all clause", b.Must)
+	}
+	if _, ok := must.Conjuncts[0].(*query.MatchAllQuery); !ok {
+		t.Errorf("got must %T, want *query.MatchAllQuery", must.Conjuncts[0])
+	}
+	if b.MustNot == nil {
+		t.Error("negated clause is missing")
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	check := func(s string) (string, error) { return s, nil }
+	tests := []struct {
+		in                         string
+		min, max                   string
+		minInclusive, maxInclusive bool
+		err                        bool
+	}{
+		{"2013", "2013", "2013", true, true, false},
+		{">2013", "2013", "", false, true, false},
+		{">=2013", "2013", "", true, true, false},
+		{"<2013", "", "2013", true, false, false},
+		{"<=2013", "", "2013", true, true, false},
+		{"2013..2015", "2013", "2015", true, true, false},
+		{"2013..", "2013", "", true, true, false},
+		{"..2015", "", "2015", true, true, false},
+		{"..", "", "", false, false, true},
+		{">", "", "", false, false, true},
+	}
+	for _, tt := range tests {
+		min, max, minInclusive, maxInclusive, err := parseRange(tt.in, check)
+		if (err != nil) != tt.err {
+			t.Errorf("parseRange(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if tt.err {
+			continue
+		}
+		if min != tt.min || max != tt.max || minInclusive != tt.minInclusive || maxInclusive != tt.maxInclusive {
+			t.Errorf("parseRange(%q) = %q %q %v %v, want %q %q %v %v", tt.in,
+				min, max, minInclusive, maxInclusive, tt.min, tt.max, tt.minInclusive, tt.maxInclusive)
+		}
+	}
+}
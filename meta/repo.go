@@ -22,7 +22,11 @@ func Init(path, url string) error {
 	if err != nil {
 		return err
 	}
-	err = initSearchIndex()
+	revision, err := repoRevision(path)
+	if err != nil {
+		return err
+	}
+	err = initSearchIndex(revision)
 	if err != nil {
 		return err
 	}
@@ -41,8 +45,14 @@ func Init(path, url string) error {
 				err = updateIndex(path)
 				if err != nil {
 					log.Printf("Failed to index repo: %v\n", err)
+					continue
 				}
-				err = initSearchIndex()
+				revision, err := repoRevision(path)
+				if err != nil {
+					log.Printf("Failed to read repo revision: %v\n", err)
+					continue
+				}
+				err = initSearchIndex(revision)
 				if err != nil {
 					log.Printf("Failed to update search index: %v\n", err)
 				}
@@ -90,6 +100,18 @@ func updateRepo(path, url string) error {
 	return err
 }
 
+func repoRevision(path string) (string, error) {
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return "", err
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return head.Hash().String(), nil
+}
+
 func initRepo(path, url string) error {
 	err := os.MkdirAll(path, os.ModePerm)
 	if err != nil {
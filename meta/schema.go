@@ -43,6 +43,8 @@ type AlbumDetails struct {
 	Artists *Artists       `json:"artists,omitempty" toml:"artists"`
 	Tags    []string       `json:"tags" toml:"tags"`
 	Discs   []*DiscDetails `json:"discs" toml:"discs"`
+	// Tags set on the album itself, Tags also collects those of its tracks
+	ownTags []string
 }
 
 type albumInfoDef struct {
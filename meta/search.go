@@ -2,50 +2,331 @@ package meta
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"os"
+	"path"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/custom"
+	keywordAnalyzer "github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/v2/analysis/token/lowercase"
+	"github.com/blevesearch/bleve/v2/analysis/tokenizer/single"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"github.com/blevesearch/bleve/v2/search/query"
 )
 
 type trackDetails struct {
-	TrackInfoWithAlbum
-	//AlbumTags []Tag
-	Tags []Tag
+	Title    string   `json:"title"`
+	Artist   string   `json:"artist"`
+	Album    string   `json:"album"`
+	Catalog  string   `json:"catalog"`
+	Date     string   `json:"date"`
+	Year     float64  `json:"year,omitempty"`
+	Type     string   `json:"type"`
+	Tags     []string `json:"tag"`
+	TagNames []string `json:"tag_name"`
+	// exact values results can be narrowed down by
+	FacetYear   string   `json:"facet_year,omitempty"`
+	FacetType   string   `json:"facet_type"`
+	FacetArtist string   `json:"facet_artist"`
+	FacetTags   []string `json:"facet_tag"`
 }
 
 type albumDetails struct {
-	AlbumDetails
-	Tags []Tag
+	Title    string   `json:"title"`
+	Artist   string   `json:"artist"`
+	Catalog  string   `json:"catalog"`
+	Date     string   `json:"date"`
+	Year     float64  `json:"year,omitempty"`
+	Type     string   `json:"type"`
+	Tags     []string `json:"tag"`
+	TagNames []string `json:"tag_name"`
+	// exact values results can be narrowed down by
+	FacetYear   string   `json:"facet_year,omitempty"`
+	FacetType   string   `json:"facet_type"`
+	FacetArtist string   `json:"facet_artist"`
+	FacetTags   []string `json:"facet_tag"`
 }
 
-var tracksSearchIdx bleve.Index
-var albumsSearchIdx bleve.Index
+type tagDetails struct {
+	Type     string   `json:"type"`
+	Tags     []string `json:"tag"`
+	TagNames []string `json:"tag_name"`
+}
+
+const keywordLowerAnalyzer = "keyword_lower"
+
+func buildIndexMapping() (*mapping.IndexMappingImpl, error) {
+	m := bleve.NewIndexMapping()
+	err := m.AddCustomAnalyzer(keywordLowerAnalyzer, map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     single.Name,
+		"token_filters": []string{lowercase.Name},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = standard.Name
+	keyword := bleve.NewTextFieldMapping()
+	keyword.Analyzer = keywordLowerAnalyzer
+	numeric := bleve.NewNumericFieldMapping()
+
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("title", text)
+	doc.AddFieldMappingsAt("artist", text)
+	doc.AddFieldMappingsAt("album", text)
+	doc.AddFieldMappingsAt("catalog", keyword)
+	doc.AddFieldMappingsAt("date", keyword)
+	doc.AddFieldMappingsAt("year", numeric)
+	doc.AddFieldMappingsAt("type", keyword)
+	doc.AddFieldMappingsAt("tag", keyword)
+	doc.AddFieldMappingsAt("tag_name", text)
+
+	facet := bleve.NewTextFieldMapping()
+	facet.Analyzer = keywordAnalyzer.Name
+	facet.IncludeInAll = false
+	for _, v := range facets {
+		doc.AddFieldMappingsAt(v.field, facet)
+	}
+	m.DefaultMapping = doc
+	m.DefaultAnalyzer = standard.Name
+
+	return m, nil
+}
+
+var facets = map[string]struct {
+	field string
+	size  int
+}{
+	"year":   {"facet_year", 20},
+	"type":   {"facet_type", 10},
+	"artist": {"facet_artist", 10},
+	"tag":    {"facet_tag", 10},
+}
+
+type Facet struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+type SearchOptions struct {
+	// Filters narrows results to the given facet values. Values of the
+	// same facet are alternatives, different facets must all match.
+	Filters map[string][]string
+	// Facets requests facet counts along with the results.
+	Facets bool
+}
+
+func facetYear(year float64) string {
+	if year == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(year))
+}
+
+func parseYear(date string) float64 {
+	if len(date) < 4 {
+		return 0
+	}
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return 0
+	}
+	return float64(year)
+}
+
+// expandTags resolves tags together with all of their ancestors, and
+// collects every name they are known by.
+func expandTags(tags []string) ([]string, []string) {
+	strs := make([]string, 0, len(tags))
+	names := make([]string, 0, len(tags))
+	if tagSet == nil {
+		return strs, names
+	}
+	visited := map[*Tag]bool{}
+	var visit func(tag *Tag)
+	visit = func(tag *Tag) {
+		if visited[tag] {
+			return
+		}
+		visited[tag] = true
+		strs = append(strs, tag.Str())
+		names = append(names, tag.Name)
+		for _, v := range tag.Names {
+			names = append(names, v)
+		}
+		for _, parent := range tag.parentTagsRef {
+			visit(parent)
+		}
+	}
+	for _, v := range tags {
+		tag, err := tagSet.FindTag(v)
+		if err != nil {
+			continue
+		}
+		visit(tag)
+	}
+	return strs, names
+}
+
+func derefOr(s *string, def string) string {
+	if s == nil {
+		return def
+	}
+	return *s
+}
+
+const searchIndexDir = "./tmp/search"
+
+// searchIndexVersion must be bumped whenever the index mapping or the
+// indexed documents change, so that indexes left on disk get rebuilt.
+const searchIndexVersion = 4
+
+type searchIndex struct {
+	name   string
+	tracks bleve.Index
+	albums bleve.Index
+	tags   bleve.Index
+}
+
+func (idx *searchIndex) Close() {
+	for _, v := range []bleve.Index{idx.tracks, idx.albums, idx.tags} {
+		if v != nil {
+			_ = v.Close()
+		}
+	}
+}
+
+var searchLock = &sync.RWMutex{}
+var searchIdx *searchIndex
+
+// initSearchIndex opens the on-disk search index built for revision,
+// building it first if it does not exist yet.
+func initSearchIndex(revision string) error {
+	name := fmt.Sprintf("%s-v%d", revision, searchIndexVersion)
+	p := path.Join(searchIndexDir, name)
+
+	searchLock.RLock()
+	current := searchIdx
+	searchLock.RUnlock()
+	if current != nil && current.name == name {
+		return nil
+	}
+
+	idx, err := openSearchIndex(name)
+	if err == nil {
+		log.Printf("Reusing search index of revision %s.\n", revision)
+		swapSearchIndex(idx)
+		removeStaleSearchIndexes(name)
+		return nil
+	}
 
-func initSearchIndex() error {
 	log.Println("Building search index...")
 	start := time.Now()
-	var err error
-	lock.RLock()
-	defer lock.RUnlock()
 
-	if tracksSearchIdx != nil {
-		_ = tracksSearchIdx.Close()
+	building := p + ".building"
+	_ = os.RemoveAll(building)
+	if err := os.MkdirAll(building, os.ModePerm); err != nil {
+		return err
 	}
-	if albumsSearchIdx != nil {
-		_ = albumsSearchIdx.Close()
+	if err := buildSearchIndex(building); err != nil {
+		_ = os.RemoveAll(building)
+		return err
+	}
+	_ = os.RemoveAll(p)
+	if err := os.Rename(building, p); err != nil {
+		return err
 	}
 
-	mapping := bleve.NewIndexMapping()
-	tracksSearchIdx, err = bleve.New("", mapping)
+	idx, err = openSearchIndex(name)
 	if err != nil {
 		return err
 	}
-	tracksBatch := tracksSearchIdx.NewBatch()
+	swapSearchIndex(idx)
+	removeStaleSearchIndexes(name)
+
+	log.Printf("Done, took %d ms.\n", time.Now().Sub(start).Milliseconds())
+
+	return nil
+}
+
+func openSearchIndex(name string) (*searchIndex, error) {
+	p := path.Join(searchIndexDir, name)
+	idx := &searchIndex{name: name}
+	for _, v := range []struct {
+		file string
+		dst  *bleve.Index
+	}{
+		{"tracks.bleve", &idx.tracks},
+		{"albums.bleve", &idx.albums},
+		{"tags.bleve", &idx.tags},
+	} {
+		i, err := bleve.Open(path.Join(p, v.file))
+		if err != nil {
+			idx.Close()
+			return nil, err
+		}
+		*v.dst = i
+	}
+	return idx, nil
+}
+
+func swapSearchIndex(idx *searchIndex) {
+	searchLock.Lock()
+	old := searchIdx
+	searchIdx = idx
+	searchLock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+}
+
+func removeStaleSearchIndexes(current string) {
+	entries, err := os.ReadDir(searchIndexDir)
+	if err != nil {
+		return
+	}
+	for _, v := range entries {
+		if v.Name() == current {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(searchIndexDir, v.Name())); err != nil {
+			log.Printf("Failed to remove stale search index %s: %v\n", v.Name(), err)
+		}
+	}
+}
+
+func buildSearchIndex(p string) error {
+	lock.RLock()
+	defer lock.RUnlock()
+
+	indexMapping, err := buildIndexMapping()
+	if err != nil {
+		return err
+	}
+	tracks, err := bleve.New(path.Join(p, "tracks.bleve"), indexMapping)
+	if err != nil {
+		return err
+	}
+	defer tracks.Close()
+	tracksBatch := tracks.NewBatch()
 	for _, album := range albumIdx {
+		year := parseYear(album.Date)
 		discId := uint(1)
 		for _, disc := range album.Discs {
+			catalog := disc.Catalog
+			if catalog == "" {
+				catalog = album.Catalog
+			}
 			trackId := uint(1)
 			for _, track := range disc.Tracks {
 				t := TrackInfoWithAlbum{
@@ -61,14 +342,21 @@ func initSearchIndex() error {
 				}
 				key, _ := json.Marshal(t)
 				val := trackDetails{
-					TrackInfoWithAlbum: t,
+					Title:   track.Title,
+					Artist:  derefOr(track.Artist, album.Artist),
+					Album:   album.Title,
+					Catalog: catalog,
+					Date:    album.Date,
+					Year:    year,
+					Type:    derefOr(track.Type, album.Type),
 				}
-				//for _, tag := range album.Tags {
-				//	val.AlbumTags = append(val.AlbumTags, tagNameIdx[tag])
-				//}
-				//for _, tagName := range albumIdx[t.AlbumID].Discs[t.DiscID-1].Tracks[t.TrackID-1].Tags {
-				//	val.Tags = append(val.Tags, tagNameIdx[tagName])
-				//}
+				// Tracks inherit the tags of their album
+				tags := append(append([]string{}, album.ownTags...), track.Tags...)
+				val.Tags, val.TagNames = expandTags(tags)
+				val.FacetYear = facetYear(val.Year)
+				val.FacetType = val.Type
+				val.FacetArtist = val.Artist
+				val.FacetTags = val.Tags
 				if err := tracksBatch.Index(string(key), val); err != nil {
 					return err
 				}
@@ -78,42 +366,137 @@ func initSearchIndex() error {
 		}
 	}
 
-	err = tracksSearchIdx.Batch(tracksBatch)
+	err = tracks.Batch(tracksBatch)
 	if err != nil {
 		return err
 	}
 
-	albumsSearchIdx, err = bleve.New("", mapping)
-	albumsBatch := albumsSearchIdx.NewBatch()
+	albums, err := bleve.New(path.Join(p, "albums.bleve"), indexMapping)
+	if err != nil {
+		return err
+	}
+	defer albums.Close()
+	albumsBatch := albums.NewBatch()
 	for _, v := range albumIdx {
 		key, _ := json.Marshal(v)
-		val := albumDetails{AlbumDetails: *v}
-		//for _, tagName := range v.Tags {
-		//	val.Tags = append(val.Tags, tagNameIdx[tagName])
-		//}
+		val := albumDetails{
+			Title:   v.Title,
+			Artist:  v.Artist,
+			Catalog: v.Catalog,
+			Date:    v.Date,
+			Year:    parseYear(v.Date),
+			Type:    v.Type,
+		}
+		val.Tags, val.TagNames = expandTags(v.Tags)
+		val.FacetYear = facetYear(val.Year)
+		val.FacetType = val.Type
+		val.FacetArtist = val.Artist
+		val.FacetTags = val.Tags
 		if err := albumsBatch.Index(string(key), val); err != nil {
 			return err
 		}
 	}
 
-	err = albumsSearchIdx.Batch(albumsBatch)
+	err = albums.Batch(albumsBatch)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Done, took %d ms.\n", time.Now().Sub(start).Milliseconds())
+	tags, err := bleve.New(path.Join(p, "tags.bleve"), indexMapping)
+	if err != nil {
+		return err
+	}
+	defer tags.Close()
+	tagsBatch := tags.NewBatch()
+	if tagSet != nil {
+		for _, v := range tagSet.tags {
+			val := tagDetails{
+				Type:     v.Type,
+				Tags:     []string{v.Str()},
+				TagNames: []string{v.Name},
+			}
+			for _, name := range v.Names {
+				val.TagNames = append(val.TagNames, name)
+			}
+			if err := tagsBatch.Index(v.Str(), val); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tags.Batch(tagsBatch)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
 
-func SearchAlbums(keyword string) []AlbumDetails {
-	query := bleve.NewMatchQuery(keyword)
-	search := bleve.NewSearchRequest(query)
+// buildSearchRequest combines keyword with the facet filters of opts.
+// It returns nil if there is nothing to search for.
+func buildSearchRequest(keyword string, opts SearchOptions) (*bleve.SearchRequest, error) {
+	var conjuncts []query.Query
+	q, err := ParseQuery(keyword)
+	if err == nil {
+		conjuncts = append(conjuncts, q)
+	} else if err != ErrEmptyQuery {
+		return nil, err
+	}
+	for name, values := range opts.Filters {
+		facet, ok := facets[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		alternatives := make([]query.Query, 0, len(values))
+		for _, v := range values {
+			t := bleve.NewTermQuery(v)
+			t.SetField(facet.field)
+			alternatives = append(alternatives, t)
+		}
+		conjuncts = append(conjuncts, bleve.NewDisjunctionQuery(alternatives...))
+	}
+	if len(conjuncts) == 0 {
+		return nil, nil
+	}
+
+	search := bleve.NewSearchRequest(bleve.NewConjunctionQuery(conjuncts...))
 	search.Size = 50
-	searchResults, err := albumsSearchIdx.Search(search)
-	if err != nil {
+	if opts.Facets {
+		for name, v := range facets {
+			search.AddFacet(name, bleve.NewFacetRequest(v.field, v.size))
+		}
+	}
+	return search, nil
+}
+
+func searchFacets(res *bleve.SearchResult) map[string][]Facet {
+	if len(res.Facets) == 0 {
 		return nil
 	}
+	ret := make(map[string][]Facet, len(res.Facets))
+	for name, v := range res.Facets {
+		entries := make([]Facet, 0)
+		if v.Terms != nil {
+			for _, term := range v.Terms.Terms() {
+				entries = append(entries, Facet{Value: term.Term, Count: term.Count})
+			}
+		}
+		ret[name] = entries
+	}
+	return ret
+}
+
+func SearchAlbums(keyword string, opts SearchOptions) ([]AlbumDetails, map[string][]Facet, error) {
+	search, err := buildSearchRequest(keyword, opts)
+	if err != nil || search == nil {
+		return nil, nil, err
+	}
+	searchLock.RLock()
+	searchResults, err := searchIdx.albums.Search(search)
+	searchLock.RUnlock()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	var res []AlbumDetails
 	sort.Sort(searchResults.Hits)
@@ -126,16 +509,19 @@ func SearchAlbums(keyword string) []AlbumDetails {
 		res = append(res, entry)
 	}
 
-	return res
+	return res, searchFacets(searchResults), nil
 }
 
-func SearchTracks(keyword string) []TrackInfoWithAlbum {
-	query := bleve.NewMatchQuery(keyword)
-	search := bleve.NewSearchRequest(query)
-	search.Size = 50
-	searchResults, err := tracksSearchIdx.Search(search)
+func SearchTracks(keyword string, opts SearchOptions) ([]TrackInfoWithAlbum, map[string][]Facet, error) {
+	search, err := buildSearchRequest(keyword, opts)
+	if err != nil || search == nil {
+		return nil, nil, err
+	}
+	searchLock.RLock()
+	searchResults, err := searchIdx.tracks.Search(search)
+	searchLock.RUnlock()
 	if err != nil {
-		return nil
+		return nil, nil, err
 	}
 
 	var res []TrackInfoWithAlbum
@@ -149,5 +535,37 @@ func SearchTracks(keyword string) []TrackInfoWithAlbum {
 		res = append(res, entry)
 	}
 
-	return res
+	return res, searchFacets(searchResults), nil
+}
+
+func SearchTags(keyword string) ([]Tag, error) {
+	query, err := ParseQuery(keyword)
+	if err == ErrEmptyQuery {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	search := bleve.NewSearchRequest(query)
+	search.Size = 50
+	searchLock.RLock()
+	searchResults, err := searchIdx.tags.Search(search)
+	searchLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Sort(searchResults.Hits)
+
+	lock.RLock()
+	defer lock.RUnlock()
+	res := make([]Tag, 0, len(searchResults.Hits))
+	for _, v := range searchResults.Hits {
+		tag, err := tagSet.FindTag(v.ID)
+		if err != nil {
+			continue
+		}
+		res = append(res, *tag)
+	}
+
+	return res, nil
 }
@@ -111,6 +111,10 @@ func (set *TagSet) ExpandTagsDef(album *AlbumDetails) error {
 	if err != nil {
 		return err
 	}
+	err = set.expandTagsDef(album.ownTags)
+	if err != nil {
+		return err
+	}
 
 	for discIdx := range album.Discs {
 		err = set.expandTagsDef(album.Discs[discIdx].Tags)
@@ -0,0 +1,285 @@
+package model
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Encrypted values look like enc:v1:<key id>:<sealed data key>:<sealed value>.
+// Every value is sealed with its own random data key, which in turn is
+// sealed with a master key, so rotating master keys only has to reseal
+// the data keys.
+const encryptedPrefix = "enc:v1:"
+
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	primaryKey *masterKey
+	masterKeys = map[string]*masterKey{}
+)
+
+var errNoKey = errors.New("encrypted value found but no matching encryption key configured")
+
+// encryptedColumns lists the columns sealed by the encrypted serializer.
+var encryptedColumns = []struct{ table, column string }{
+	{"users", "secret"},
+	{"tokens", "token"},
+}
+
+func init() {
+	schema.RegisterSerializer("encrypted", EncryptedSerializer{})
+}
+
+// SetEncryptionKeys configures the master keys, each a base64 encoded
+// 32 byte key. New values are sealed with primary, old keys are only
+// used to open existing values. Without a primary key values are
+// stored in plaintext.
+func SetEncryptionKeys(primary string, old []string) error {
+	primaryKey = nil
+	masterKeys = map[string]*masterKey{}
+	for i, v := range append([]string{primary}, old...) {
+		if v == "" {
+			continue
+		}
+		key, err := newMasterKey(v)
+		if err != nil {
+			return err
+		}
+		masterKeys[key.id] = key
+		if i == 0 {
+			primaryKey = key
+		}
+	}
+	return nil
+}
+
+// EncryptionEnabled reports whether a primary key is configured.
+func EncryptionEnabled() bool {
+	return primaryKey != nil
+}
+
+func newMasterKey(encoded string) (*masterKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(raw) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes encoded in base64")
+	}
+	aead, err := newAEAD(raw)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &masterKey{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain, additional []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additional)
+}
+
+// encryptValue seals plain with a new data key under the primary key.
+// Empty values and values without a configured key are kept as is.
+func encryptValue(plain string) (string, error) {
+	if plain == "" || primaryKey == nil {
+		return plain, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	sealedValue, err := seal(aead, []byte(plain), nil)
+	if err != nil {
+		return "", err
+	}
+	sealedKey, err := seal(primaryKey.aead, dataKey, []byte(primaryKey.id))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + primaryKey.id + ":" + base64.RawStdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedValue), nil
+}
+
+// parseEncrypted splits an encrypted value, returning ok false for
+// plaintext values.
+func parseEncrypted(s string) (keyID string, sealedKey, sealedValue []byte, ok bool, err error) {
+	if !strings.HasPrefix(s, encryptedPrefix) {
+		return "", nil, nil, false, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(s, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, true, errors.New("malformed encrypted value")
+	}
+	if sealedKey, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return "", nil, nil, true, err
+	}
+	if sealedValue, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return "", nil, nil, true, err
+	}
+	return parts[0], sealedKey, sealedValue, true, nil
+}
+
+func openDataKey(keyID string, sealedKey []byte) ([]byte, error) {
+	key, found := masterKeys[keyID]
+	if !found {
+		return nil, errNoKey
+	}
+	return open(key.aead, sealedKey, []byte(keyID))
+}
+
+// decryptValue opens a value sealed by encryptValue. Plaintext values
+// written before encryption was enabled are returned unchanged.
+func decryptValue(s string) (string, error) {
+	keyID, sealedKey, sealedValue, ok, err := parseEncrypted(s)
+	if !ok || err != nil {
+		return s, err
+	}
+	dataKey, err := openDataKey(keyID, sealedKey)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plain, err := open(aead, sealedValue, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// resealValue brings a stored value up to date with the primary key,
+// encrypting plaintext and resealing data keys of other master keys.
+// It reports whether the value changed.
+func resealValue(s string) (string, bool, error) {
+	if s == "" || primaryKey == nil {
+		return s, false, nil
+	}
+	keyID, sealedKey, sealedValue, ok, err := parseEncrypted(s)
+	if err != nil {
+		return "", false, err
+	}
+	if !ok {
+		res, err := encryptValue(s)
+		return res, err == nil, err
+	}
+	if keyID == primaryKey.id {
+		return s, false, nil
+	}
+	dataKey, err := openDataKey(keyID, sealedKey)
+	if err != nil {
+		return "", false, err
+	}
+	if sealedKey, err = seal(primaryKey.aead, dataKey, []byte(primaryKey.id)); err != nil {
+		return "", false, err
+	}
+	return encryptedPrefix + primaryKey.id + ":" + base64.RawStdEncoding.EncodeToString(sealedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealedValue), true, nil
+}
+
+// ResealColumns encrypts values stored in plaintext and moves values
+// sealed with old keys to the primary key. It returns the number of
+// updated values.
+func ResealColumns(db *gorm.DB) (int, error) {
+	if primaryKey == nil {
+		return 0, nil
+	}
+	updated := 0
+	for _, c := range encryptedColumns {
+		type row struct {
+			ID    uint
+			Value string
+		}
+		var rows []row
+		if err := db.Table(c.table).Select("id", c.column+" AS value").
+			Where(c.column + " IS NOT NULL AND " + c.column + " <> ''").Find(&rows).Error; err != nil {
+			return updated, err
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for _, r := range rows {
+				value, changed, err := resealValue(r.Value)
+				if err != nil {
+					return fmt.Errorf("%s.%s of row %d: %w", c.table, c.column, r.ID, err)
+				}
+				if !changed {
+					continue
+				}
+				if err := tx.Table(c.table).Where("id = ?", r.ID).Update(c.column, value).Error; err != nil {
+					return err
+				}
+				updated++
+			}
+			return nil
+		})
+		if err != nil {
+			return updated, err
+		}
+	}
+	return updated, nil
+}
+
+// EncryptedSerializer transparently seals string fields tagged with
+// serializer:encrypted.
+type EncryptedSerializer struct{}
+
+func (EncryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var s string
+	switch v := dbValue.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	case nil:
+	default:
+		return fmt.Errorf("unsupported value %T for encrypted field %s", dbValue, field.Name)
+	}
+	plain, err := decryptValue(s)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", field.Name, err)
+	}
+	return field.Set(ctx, dst, plain)
+}
+
+func (EncryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	s, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("encrypted field %s must be a string", field.Name)
+	}
+	return encryptValue(s)
+}
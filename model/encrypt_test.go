@@ -0,0 +1,204 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestKey(t *testing.T) string {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func setTestKeys(t *testing.T, primary string, old ...string) {
+	if err := SetEncryptionKeys(primary, old); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = SetEncryptionKeys("", nil) })
+}
+
+func TestSetEncryptionKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary string
+		old     []string
+		err     bool
+		enabled bool
+	}{
+		{"none", "", nil, false, false},
+		{"primary", newTestKey(t), nil, false, true},
+		{"only old keys", "", []string{newTestKey(t)}, false, false},
+		{"not base64", "not a key!", nil, true, false},
+		{"too short", base64.StdEncoding.EncodeToString(make([]byte, 16)), nil, true, false},
+	}
+	for _, tt := range tests {
+		err := SetEncryptionKeys(tt.primary, tt.old)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error = %v, want error %v", tt.name, err, tt.err)
+		}
+		if err == nil && EncryptionEnabled() != tt.enabled {
+			t.Errorf("%s: enabled = %v, want %v", tt.name, EncryptionEnabled(), tt.enabled)
+		}
+	}
+	_ = SetEncryptionKeys("", nil)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	setTestKeys(t, newTestKey(t))
+	for _, plain := range []string{"", "JBSWY3DPEHPK3PXP", "token:with:colons", "ユニコード", strings.Repeat("x", 4096)} {
+		sealed, err := encryptValue(plain)
+		if err != nil {
+			t.Fatalf("encryptValue(%q) error: %v", plain, err)
+		}
+		if plain != "" && (!strings.HasPrefix(sealed, encryptedPrefix) || strings.Contains(sealed, plain)) {
+			t.Errorf("encryptValue(%q) = %q, not sealed", plain, sealed)
+		}
+		got, err := decryptValue(sealed)
+		if err != nil || got != plain {
+			t.Errorf("decryptValue(encryptValue(%q)) = %q, %v", plain, got, err)
+		}
+	}
+	a, _ := encryptValue("same")
+	b, _ := encryptValue("same")
+	if a == b {
+		t.Error("equal values sealed to the same ciphertext")
+	}
+}
+
+func TestEncryptWithoutKey(t *testing.T) {
+	setTestKeys(t, "")
+	sealed, err := encryptValue("secret")
+	if err != nil || sealed != "secret" {
+		t.Errorf("encryptValue without key = %q, %v, want plaintext", sealed, err)
+	}
+	if got, err := decryptValue("secret"); err != nil || got != "secret" {
+		t.Errorf("decryptValue(plaintext) = %q, %v", got, err)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	key := newTestKey(t)
+	setTestKeys(t, key)
+	sealed, err := encryptValue("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(sealed, encryptedPrefix), ":")
+	value, _ := base64.RawStdEncoding.DecodeString(parts[2])
+	value[len(value)-1] ^= 1
+	tampered := encryptedPrefix + parts[0] + ":" + parts[1] + ":" + base64.RawStdEncoding.EncodeToString(value)
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"malformed", encryptedPrefix + "abc"},
+		{"bad base64", encryptedPrefix + parts[0] + ":!!:" + parts[2]},
+		{"unknown key", encryptedPrefix + "00000000:" + parts[1] + ":" + parts[2]},
+		{"swapped key and value", encryptedPrefix + parts[0] + ":" + parts[2] + ":" + parts[1]},
+		{"tampered value", tampered},
+	}
+	for _, tt := range tests {
+		if _, err := decryptValue(tt.value); err == nil {
+			t.Errorf("%s: decryptValue succeeded", tt.name)
+		}
+	}
+
+	setTestKeys(t, newTestKey(t))
+	if _, err := decryptValue(sealed); err != errNoKey {
+		t.Errorf("decryptValue with a removed key error = %v, want errNoKey", err)
+	}
+}
+
+func TestResealValue(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	setTestKeys(t, oldKey)
+	sealedOld, err := encryptValue("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestKeys(t, newKey, oldKey)
+	sealedNew, err := encryptValue("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		changed bool
+	}{
+		{"empty", "", false},
+		{"plaintext", "secret", true},
+		{"old key", sealedOld, true},
+		{"primary key", sealedNew, false},
+	}
+	for _, tt := range tests {
+		got, changed, err := resealValue(tt.value)
+		if err != nil {
+			t.Errorf("%s: error: %v", tt.name, err)
+			continue
+		}
+		if changed != tt.changed {
+			t.Errorf("%s: changed = %v, want %v", tt.name, changed, tt.changed)
+		}
+		if tt.value == "" {
+			continue
+		}
+		if !strings.HasPrefix(got, encryptedPrefix+primaryKey.id+":") {
+			t.Errorf("%s: resealed to %q, not under the primary key", tt.name, got)
+		}
+		if plain, err := decryptValue(got); err != nil || plain != "secret" {
+			t.Errorf("%s: resealed value opens to %q, %v", tt.name, plain, err)
+		}
+	}
+
+	// once resealed the old key is no longer needed
+	resealed, _, _ := resealValue(sealedOld)
+	setTestKeys(t, newKey)
+	if plain, err := decryptValue(resealed); err != nil || plain != "secret" {
+		t.Errorf("resealed value without the old key opens to %q, %v", plain, err)
+	}
+}
+
+func TestEncryptedColumns(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+	user := User{Email: "a@example.com", Secret: "JBSWY3DPEHPK3PXP"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestKey(t)
+	setTestKeys(t, key)
+	n, err := ResealColumns(db)
+	if err != nil || n != 1 {
+		t.Fatalf("ResealColumns = %d, %v, want 1 updated value", n, err)
+	}
+	var raw string
+	db.Table("users").Select("secret").Where("id = ?", user.ID).Scan(&raw)
+	if !strings.HasPrefix(raw, encryptedPrefix) || strings.Contains(raw, user.Secret) {
+		t.Errorf("stored secret %q is not sealed", raw)
+	}
+	got := User{}
+	if err := db.First(&got, user.ID).Error; err != nil || got.Secret != user.Secret {
+		t.Errorf("loaded secret %q, %v, want %q", got.Secret, err, user.Secret)
+	}
+	if n, err := ResealColumns(db); err != nil || n != 0 {
+		t.Errorf("second ResealColumns = %d, %v, want nothing to do", n, err)
+	}
+}
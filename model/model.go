@@ -8,6 +8,11 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 type User struct {
 	gorm.Model
 	Password  string
@@ -15,7 +20,24 @@ type User struct {
 	Nickname  string
 	Avatar    string
 	Enable2FA bool
-	Secret    string
+	Secret    string `gorm:"serializer:encrypted"`
+	// Whether the user can be found in user search
+	Discoverable  bool
+	Role          string `gorm:"default:user"`
+	Disabled      bool
+	InviterID     *uint `gorm:"index"`
+	InviteID      *uint
+	EmailVerified bool
+}
+
+type Invite struct {
+	gorm.Model
+	Code      string `gorm:"uniqueIndex"`
+	CreatorID uint   `gorm:"index"`
+	Creator   User
+	MaxUses   int
+	Uses      int
+	ExpiresAt *time.Time
 }
 
 type Session struct {
@@ -28,12 +50,77 @@ type Session struct {
 	IP           string
 }
 
+type WebAuthnCredential struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	Name   string
+	// Base64url encoded credential id
+	CredentialID    string `gorm:"uniqueIndex"`
+	PublicKey       []byte
+	AttestationType string
+	// Comma separated authenticator transports
+	Transports     string
+	AAGUID         []byte
+	SignCount      uint32
+	BackupEligible bool
+	BackupState    bool
+	LastUsed       *time.Time
+}
+
+// UserIdentity links a user to an account of an external oidc provider.
+type UserIdentity struct {
+	gorm.Model
+	UserID   uint   `gorm:"index"`
+	Provider string `gorm:"uniqueIndex:idx_identity"`
+	Subject  string `gorm:"uniqueIndex:idx_identity"`
+	Email    string
+}
+
+// AccessToken is a personal token for authenticating api requests
+// without a session.
+type AccessToken struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	Name   string
+	// Hex encoded sha256 of the token
+	Hash string `gorm:"uniqueIndex"`
+	// Comma separated scopes
+	Scopes    string
+	ExpiresAt *time.Time
+	LastUsed  *time.Time
+	LastIP    string
+}
+
+type RecoveryCode struct {
+	gorm.Model
+	UserID uint `gorm:"index"`
+	// Hex encoded sha256 of the normalized code
+	Hash string
+}
+
+// AuditEvent records a security relevant action. Events are only ever
+// appended, never updated or deleted.
+type AuditEvent struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	// The account the event concerns, nil if none could be determined
+	UserID *uint `gorm:"index"`
+	// The authenticated user performing the action, differs from UserID
+	// for admin actions and is nil before login
+	ActorID   *uint  `gorm:"index"`
+	Action    string `gorm:"index"`
+	Success   bool
+	IP        string
+	UserAgent string
+	Detail    string
+}
+
 type Token struct {
 	gorm.Model
 	TokenID    string `gorm:"uniqueIndex"`
 	Name       string
 	URL        string
-	Token      string
+	Token      string `gorm:"serializer:encrypted"`
 	Priority   int
 	UserID     uint `gorm:"index"`
 	User       User
@@ -105,8 +192,9 @@ type Lyric struct {
 	Language string `gorm:"uniqueIndex:lyric_index"`
 	Type     string `gorm:"check:type='text' OR type='lrc'"`
 	Data     string
-	UserID   uint
-	User     User
+	// Nil once the contributor deleted the account and chose anonymization
+	UserID *uint
+	User   User
 	// Is track original language
 	Source bool
 	// Lyric source
@@ -139,7 +227,10 @@ func (l *Lyric) BeforeCreate(tx *gorm.DB) error {
 }
 
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(
+	// Users registered before email verification was introduced are
+	// treated as verified
+	verifyExisting := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "EmailVerified")
+	err := db.AutoMigrate(
 		&User{},
 		&Session{},
 		&Token{},
@@ -151,5 +242,18 @@ func AutoMigrate(db *gorm.DB) error {
 		&FavoriteAlbum{},
 		&Lyric{},
 		&PlayRecord{},
+		&Invite{},
+		&WebAuthnCredential{},
+		&RecoveryCode{},
+		&UserIdentity{},
+		&AccessToken{},
+		&AuditEvent{},
 	)
+	if err != nil {
+		return err
+	}
+	if !verifyExisting {
+		return nil
+	}
+	return db.Model(&User{}).Where("1 = 1").Update("email_verified", true).Error
 }
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const accessTokenPrefix = "anniv_"
+
+const (
+	// ScopeRead allows every GET request the token may access at all
+	ScopeRead     = "read"
+	ScopePlaylist = "playlist"
+	ScopeFavorite = "favorite"
+	ScopeStat     = "stat"
+	ScopeLyric    = "lyric"
+	ScopeShare    = "share"
+)
+
+// scopeRoutes maps path prefixes to the scope needed for modifying
+// requests on them.
+var scopeRoutes = []struct {
+	prefix string
+	scope  string
+}{
+	{"/api/playlist", ScopePlaylist},
+	{"/api/favorite", ScopeFavorite},
+	{"/api/stat", ScopeStat},
+	{"/api/lyric", ScopeLyric},
+	{"/api/share", ScopeShare},
+}
+
+// Account management is only available with a session, regardless of
+// the scopes of a token.
+var sessionOnlyRoutes = []string{
+	"/api/user",
+	"/api/features",
+	"/api/admin",
+	"/api/invite",
+}
+
+var tokenReadableUserRoutes = []string{
+	"/api/user/info",
+	"/api/user/intro",
+}
+
+func validScope(scope string) bool {
+	switch scope {
+	case ScopeRead, ScopePlaylist, ScopeFavorite, ScopeStat, ScopeLyric, ScopeShare:
+		return true
+	}
+	return false
+}
+
+func EndpointAccessToken(ng *gin.Engine) {
+	g := ng.Group("/api/user/access-tokens", AuthRequired)
+
+	g.GET("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		var tokens []model.AccessToken
+		if err := db.Where("user_id = ?", user.ID).Order("created_at DESC").
+			Find(&tokens).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		res := make([]AccessTokenInfo, 0, len(tokens))
+		for _, v := range tokens {
+			res = append(res, accessTokenInfo(v))
+		}
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	g.POST("", TFARequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := CreateAccessTokenForm{}
+		if err := ctx.ShouldBind(&form); err != nil || form.Name == "" || len(form.Scopes) == 0 ||
+			form.ExpiresIn < 0 {
+			ctx.JSON(http.StatusOK, illegalParams("malformed access token form"))
+			return
+		}
+		for _, v := range form.Scopes {
+			if !validScope(v) {
+				ctx.JSON(http.StatusOK, illegalParams("unknown scope "+v))
+				return
+			}
+		}
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			ctx.JSON(http.StatusOK, resErr(InternalError, err.Error()))
+			return
+		}
+		raw := accessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+		token := model.AccessToken{
+			UserID: user.ID,
+			Name:   form.Name,
+			Hash:   hashAccessToken(raw),
+			Scopes: strings.Join(form.Scopes, ","),
+		}
+		if form.ExpiresIn != 0 {
+			expires := time.Now().Add(time.Duration(form.ExpiresIn) * time.Second)
+			token.ExpiresAt = &expires
+		}
+		if err := db.Create(&token).Error; err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditAccessTokenCreate, user.ID, true, token.Name+" ("+token.Scopes+")")
+		info := accessTokenInfo(token)
+		info.Token = raw
+		ctx.JSON(http.StatusOK, resOk(info))
+	})
+
+	g.DELETE("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := DeleteForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed delete form"))
+			return
+		}
+		res := db.Unscoped().Where("id = ? AND user_id = ?", form.ID, user.ID).Delete(&model.AccessToken{})
+		if res.Error != nil {
+			ctx.JSON(http.StatusOK, writeErr(res.Error))
+			return
+		}
+		if res.RowsAffected == 0 {
+			ctx.JSON(http.StatusOK, resErr(NotFound, "access token not found"))
+			return
+		}
+		audit(ctx, AuditAccessTokenDelete, user.ID, true, form.ID)
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token of an Authorization: Bearer header.
+func bearerToken(ctx *gin.Context) (string, bool) {
+	header := ctx.GetHeader("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// authAccessToken authenticates a request by a personal access token.
+// It aborts the request unless the token is valid and its scopes cover
+// the route.
+func authAccessToken(ctx *gin.Context, raw string) {
+	token := model.AccessToken{}
+	if db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)}).
+		Where("hash = ?", hashAccessToken(raw)).First(&token).Error != nil ||
+		(token.ExpiresAt != nil && time.Now().After(*token.ExpiresAt)) {
+		ctx.JSON(http.StatusOK, unauthorized())
+		ctx.Abort()
+		return
+	}
+	user := model.User{}
+	if err := db.Where("id = ?", token.UserID).First(&user).Error; err != nil {
+		ctx.JSON(http.StatusOK, unauthorized())
+		ctx.Abort()
+		return
+	}
+	if user.Disabled {
+		ctx.JSON(http.StatusOK, userDisabled())
+		ctx.Abort()
+		return
+	}
+	if !accessTokenAllows(strings.Split(token.Scopes, ","), ctx.Request.Method, ctx.Request.URL.Path) {
+		ctx.JSON(http.StatusOK, resErr(PermissionDenied, "access token scope insufficient"))
+		ctx.Abort()
+		return
+	}
+	if token.LastUsed == nil || time.Since(*token.LastUsed) > time.Minute*5 || token.LastIP != ctx.ClientIP() {
+		now := time.Now()
+		db.Model(&token).Updates(map[string]interface{}{"last_used": &now, "last_ip": ctx.ClientIP()})
+	}
+	ctx.Set("user", user)
+	ctx.Set("access_token", token)
+}
+
+func accessTokenAllows(scopes []string, method, path string) bool {
+	has := func(scope string) bool {
+		for _, v := range scopes {
+			if v == scope {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range sessionOnlyRoutes {
+		if routeMatches(path, v) {
+			if method != http.MethodGet {
+				return false
+			}
+			readable := false
+			for _, r := range tokenReadableUserRoutes {
+				readable = readable || routeMatches(path, r)
+			}
+			if !readable {
+				return false
+			}
+		}
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return has(ScopeRead)
+	}
+	for _, v := range scopeRoutes {
+		if routeMatches(path, v.prefix) {
+			return has(v.scope)
+		}
+	}
+	return false
+}
+
+func routeMatches(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	ActionVerifyEmail   = "verify_email"
+	ActionResetPassword = "reset_password"
+	ActionChangeEmail   = "change_email"
+)
+
+var errInvalidActionToken = errors.New("invalid or expired token")
+
+// ActionClaims are carried by the signed tokens sent out in mails.
+// Fingerprint ties a token to the state of the user it was issued for,
+// so that it stops working once the action has been carried out.
+type ActionClaims struct {
+	jwt.RegisteredClaims
+	Action      string `json:"action"`
+	Email       string `json:"email"`
+	Fingerprint string `json:"fingerprint"`
+	// Address the user is changing to, only set for change_email
+	NewEmail string `json:"new_email,omitempty"`
+}
+
+func actionFingerprint(action string, user model.User) string {
+	var state string
+	switch action {
+	case ActionVerifyEmail:
+		state = strconv.FormatBool(user.EmailVerified)
+	case ActionResetPassword, ActionChangeEmail:
+		state = user.Password
+	}
+	sum := sha256.Sum256([]byte(action + "\x00" + user.Email + "\x00" + state))
+	return hex.EncodeToString(sum[:8])
+}
+
+func signActionToken(action string, user model.User, ttl time.Duration) (string, error) {
+	return signActionClaims(newActionClaims(action, user, ttl))
+}
+
+func newActionClaims(action string, user model.User, ttl time.Duration) ActionClaims {
+	return ActionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "anniv",
+			Subject:   strconv.Itoa(int(user.ID)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+		Action:      action,
+		Email:       user.Email,
+		Fingerprint: actionFingerprint(action, user),
+	}
+}
+
+func signActionClaims(claims ActionClaims) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(config.Cfg.Secret))
+}
+
+// parseActionToken verifies a token issued for action and returns the
+// user it belongs to.
+func parseActionToken(action, token string) (*model.User, *ActionClaims, error) {
+	claims := &ActionClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errInvalidActionToken
+		}
+		return []byte(config.Cfg.Secret), nil
+	})
+	if err != nil || claims.Action != action {
+		return nil, nil, errInvalidActionToken
+	}
+	user := model.User{}
+	if err := db.Where("id = ?", claims.Subject).First(&user).Error; err != nil {
+		return nil, nil, errInvalidActionToken
+	}
+	if user.Email != claims.Email || actionFingerprint(action, user) != claims.Fingerprint {
+		return nil, nil, errInvalidActionToken
+	}
+	return &user, claims, nil
+}
+
+func actionLink(path, token string) string {
+	return config.Cfg.SiteURL + path + "?token=" + token
+}
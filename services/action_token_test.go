@@ -0,0 +1,113 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestActionFingerprint(t *testing.T) {
+	base := model.User{Email: "a@example.com", Password: "hash", EmailVerified: false}
+	tests := []struct {
+		name    string
+		change  func(u *model.User)
+		changes map[string]bool
+	}{
+		{"nickname", func(u *model.User) { u.Nickname = "other" }, map[string]bool{
+			ActionVerifyEmail: false, ActionResetPassword: false, ActionChangeEmail: false,
+		}},
+		{"email", func(u *model.User) { u.Email = "b@example.com" }, map[string]bool{
+			ActionVerifyEmail: true, ActionResetPassword: true, ActionChangeEmail: true,
+		}},
+		{"password", func(u *model.User) { u.Password = "new hash" }, map[string]bool{
+			ActionVerifyEmail: false, ActionResetPassword: true, ActionChangeEmail: true,
+		}},
+		{"cleared password", func(u *model.User) { u.Password = "" }, map[string]bool{
+			ActionVerifyEmail: false, ActionResetPassword: true, ActionChangeEmail: true,
+		}},
+		{"verified", func(u *model.User) { u.EmailVerified = true }, map[string]bool{
+			ActionVerifyEmail: true, ActionResetPassword: false, ActionChangeEmail: false,
+		}},
+	}
+	for _, tt := range tests {
+		changed := base
+		tt.change(&changed)
+		for action, want := range tt.changes {
+			got := actionFingerprint(action, base) != actionFingerprint(action, changed)
+			if got != want {
+				t.Errorf("%s: %s fingerprint changed = %v, want %v", tt.name, action, got, want)
+			}
+		}
+	}
+	if actionFingerprint(ActionResetPassword, base) == actionFingerprint(ActionChangeEmail, base) {
+		t.Error("fingerprints of different actions are equal")
+	}
+}
+
+func TestParseActionToken(t *testing.T) {
+	setupTestDB(t)
+	secret := config.Cfg.Secret
+	config.Cfg.Secret = "test secret"
+	t.Cleanup(func() { config.Cfg.Secret = secret })
+
+	user := model.User{Email: "a@example.com", Password: "hash"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	sign := func(claims ActionClaims) string {
+		token, err := signActionClaims(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign(newActionClaims(ActionResetPassword, user, time.Hour))
+	expired := sign(newActionClaims(ActionResetPassword, user, -time.Minute))
+	changed := user
+	changed.Password = "old hash"
+	stale := sign(newActionClaims(ActionResetPassword, changed, time.Hour))
+	otherUser := newActionClaims(ActionResetPassword, user, time.Hour)
+	otherUser.Subject = "999"
+	otherEmail := newActionClaims(ActionResetPassword, user, time.Hour)
+	otherEmail.Email = "b@example.com"
+	foreign, err := jwt.NewWithClaims(jwt.SigningMethodHS256, newActionClaims(ActionResetPassword, user, time.Hour)).
+		SignedString([]byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, newActionClaims(ActionResetPassword, user, time.Hour)).
+		SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		action string
+		token  string
+		ok     bool
+	}{
+		{"valid", ActionResetPassword, valid, true},
+		{"other action", ActionChangeEmail, valid, false},
+		{"expired", ActionResetPassword, expired, false},
+		{"stale fingerprint", ActionResetPassword, stale, false},
+		{"unknown user", ActionResetPassword, sign(otherUser), false},
+		{"other email", ActionResetPassword, sign(otherEmail), false},
+		{"other secret", ActionResetPassword, foreign, false},
+		{"unsigned", ActionResetPassword, unsigned, false},
+		{"garbage", ActionResetPassword, "not a token", false},
+	}
+	for _, tt := range tests {
+		got, claims, err := parseActionToken(tt.action, tt.token)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: parseActionToken error = %v, want ok %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && (got.ID != user.ID || claims.Action != tt.action) {
+			t.Errorf("%s: parsed user %d, action %s", tt.name, got.ID, claims.Action)
+		}
+	}
+}
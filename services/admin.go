@@ -0,0 +1,212 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+func EndpointAdmin(ng *gin.Engine) {
+	g := ng.Group("/api/admin", AuthRequired, AdminRequired)
+
+	g.GET("/users", func(ctx *gin.Context) {
+		limit, offset, ok := pagination(ctx)
+		if !ok {
+			return
+		}
+		tx := db.Model(&model.User{})
+		if keyword := ctx.Query("keyword"); keyword != "" {
+			keyword = escapeLike(strings.ToLower(keyword))
+			tx = tx.Where("LOWER(nickname) LIKE '%' || ? || '%' ESCAPE '\\' OR LOWER(email) LIKE '%' || ? || '%' ESCAPE '\\'",
+				keyword, keyword)
+		}
+		var users []model.User
+		if err := tx.Order("id").Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		res := make([]AdminUserInfo, 0, len(users))
+		for _, v := range users {
+			res = append(res, adminUserInfo(v))
+		}
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	g.PATCH("/user", func(ctx *gin.Context) {
+		admin := ctx.MustGet("user").(model.User)
+		form := AdminUserPatchForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed user patch form"))
+			return
+		}
+		user, ok := findAdminTarget(ctx, form.UserID)
+		if !ok {
+			return
+		}
+		if user.ID == admin.ID {
+			ctx.JSON(http.StatusOK, resErr(PermissionDenied, "cannot modify yourself"))
+			return
+		}
+		if form.Role != nil {
+			if *form.Role != model.RoleUser && *form.Role != model.RoleAdmin {
+				ctx.JSON(http.StatusOK, illegalParams("invalid role"))
+				return
+			}
+			user.Role = *form.Role
+		}
+		if form.Disabled != nil {
+			user.Disabled = *form.Disabled
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&user).Error; err != nil {
+				return err
+			}
+			if !user.Disabled {
+				return nil
+			}
+			return tx.Where("user_id=?", user.ID).Unscoped().Delete(&model.Session{}).Error
+		})
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditAdminUserUpdate, user.ID, true, fmt.Sprintf("role %s, disabled %t", user.Role, user.Disabled))
+		ctx.JSON(http.StatusOK, resOk(adminUserInfo(user)))
+	})
+
+	g.POST("/user/password", func(ctx *gin.Context) {
+		form := AdminPasswordForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed password form"))
+			return
+		}
+		user, ok := findAdminTarget(ctx, form.UserID)
+		if !ok {
+			return
+		}
+		// Without a new password the current one is cleared and the user has
+		// to choose one through the reset mail. Setting it directly is kept
+		// for instances without mail, the admin then has to hand it over.
+		if form.NewPassword == "" {
+			if !mailEnabled() {
+				ctx.JSON(http.StatusOK, illegalParams("mail is disabled, a new password is required"))
+				return
+			}
+			user.Password = ""
+		} else {
+			if msg := checkPasswordPolicy(form.NewPassword); msg != "" {
+				ctx.JSON(http.StatusOK, weakPassword(msg))
+				return
+			}
+			hash, err := hashPassword(form.NewPassword)
+			if err != nil {
+				ctx.JSON(http.StatusOK, illegalParams("failed to hash password"))
+				return
+			}
+			user.Password = hash
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&user).Error; err != nil {
+				return err
+			}
+			return tx.Where("user_id=?", user.ID).Unscoped().Delete(&model.Session{}).Error
+		})
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		if user.Password == "" {
+			// the reset token is bound to the cleared password
+			sendResetPasswordMail(user)
+			audit(ctx, AuditAdminPasswordReset, user.ID, true, "reset mail sent")
+		} else {
+			audit(ctx, AuditAdminPasswordReset, user.ID, true, "")
+		}
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.DELETE("/user/2fa", func(ctx *gin.Context) {
+		form := AdminUserForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed user form"))
+			return
+		}
+		user, ok := findAdminTarget(ctx, form.UserID)
+		if !ok {
+			return
+		}
+		user.Enable2FA = false
+		user.Secret = ""
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&user).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&model.RecoveryCode{}).Error; err != nil {
+				return err
+			}
+			return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&model.WebAuthnCredential{}).Error
+		})
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditAdminTFAReset, user.ID, true, "")
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.DELETE("/user", func(ctx *gin.Context) {
+		admin := ctx.MustGet("user").(model.User)
+		form := AdminDeleteUserForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed user form"))
+			return
+		}
+		user, ok := findAdminTarget(ctx, form.UserID)
+		if !ok {
+			return
+		}
+		if user.ID == admin.ID {
+			ctx.JSON(http.StatusOK, resErr(PermissionDenied, "cannot delete yourself"))
+			return
+		}
+		heir, ok := lyricHeir(ctx, user, form.RevokeForm)
+		if !ok {
+			return
+		}
+		var playlists []uint
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			playlists, err = deleteUserData(tx, user, heir)
+			return err
+		})
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		for _, v := range playlists {
+			unindexPlaylist(v)
+		}
+		removeAvatar(user.Avatar)
+		audit(ctx, AuditAdminUserDelete, user.ID, true, user.Email)
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+}
+
+func findAdminTarget(ctx *gin.Context, id string) (model.User, bool) {
+	var user model.User
+	uid, err := strconv.Atoi(id)
+	if err != nil {
+		ctx.JSON(http.StatusOK, userNotFound())
+		return user, false
+	}
+	if err := db.Where("id = ?", uid).First(&user).Error; err != nil {
+		ctx.JSON(http.StatusOK, userNotFound())
+		return user, false
+	}
+	return user, true
+}
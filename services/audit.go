@@ -0,0 +1,168 @@
+package services
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	AuditRegister           = "register"
+	AuditLogin              = "login"
+	AuditLogout             = "logout"
+	AuditAccountDelete      = "account_delete"
+	AuditPasswordChange     = "password_change"
+	AuditPasswordReset      = "password_reset"
+	AuditEmailVerify        = "email_verify"
+	AuditEmailChange        = "email_change"
+	AuditSecondFactor       = "2fa_verify"
+	AuditTFAEnable          = "2fa_enable"
+	AuditTFADisable         = "2fa_disable"
+	AuditRecoveryReset      = "recovery_codes_reset"
+	AuditPasskeyAdd         = "passkey_add"
+	AuditPasskeyDelete      = "passkey_delete"
+	AuditIdentityLink       = "identity_link"
+	AuditIdentityUnlink     = "identity_unlink"
+	AuditSessionRevoke      = "session_revoke"
+	AuditTokenCreate        = "token_create"
+	AuditTokenUpdate        = "token_update"
+	AuditTokenDelete        = "token_delete"
+	AuditTokenRenew         = "token_renew"
+	AuditAccessTokenCreate  = "access_token_create"
+	AuditAccessTokenDelete  = "access_token_delete"
+	AuditShareCreate        = "share_create"
+	AuditShareDelete        = "share_delete"
+	AuditAdminUserUpdate    = "admin_user_update"
+	AuditAdminPasswordReset = "admin_password_reset"
+	AuditAdminTFAReset      = "admin_2fa_reset"
+	AuditAdminUserDelete    = "admin_user_delete"
+)
+
+func EndpointAudit(ng *gin.Engine) {
+	ng.GET("/api/user/audit", AuthRequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		limit, offset, ok := pagination(ctx)
+		if !ok {
+			return
+		}
+		tx := db.Where("user_id = ?", user.ID)
+		if action := ctx.Query("action"); action != "" {
+			tx = tx.Where("action = ?", action)
+		}
+		queryAuditEvents(ctx, tx, limit, offset)
+	})
+
+	ng.GET("/api/admin/audit", AuthRequired, AdminRequired, func(ctx *gin.Context) {
+		limit, offset, ok := pagination(ctx)
+		if !ok {
+			return
+		}
+		tx := db.Model(&model.AuditEvent{})
+		for _, v := range []string{"user_id", "actor_id"} {
+			if ctx.Query(v) == "" {
+				continue
+			}
+			id, err := strconv.Atoi(ctx.Query(v))
+			if err != nil {
+				ctx.JSON(http.StatusOK, illegalParams(v))
+				return
+			}
+			tx = tx.Where(v+" = ?", id)
+		}
+		for _, v := range []string{"action", "ip"} {
+			if ctx.Query(v) != "" {
+				tx = tx.Where(v+" = ?", ctx.Query(v))
+			}
+		}
+		if ctx.Query("success") != "" {
+			success, err := strconv.ParseBool(ctx.Query("success"))
+			if err != nil {
+				ctx.JSON(http.StatusOK, illegalParams("success"))
+				return
+			}
+			tx = tx.Where("success = ?", success)
+		}
+		for _, v := range []struct{ param, cond string }{{"since", "created_at >= ?"}, {"until", "created_at < ?"}} {
+			if ctx.Query(v.param) == "" {
+				continue
+			}
+			t, err := strconv.ParseInt(ctx.Query(v.param), 10, 64)
+			if err != nil {
+				ctx.JSON(http.StatusOK, illegalParams(v.param))
+				return
+			}
+			tx = tx.Where(v.cond, time.Unix(t, 0))
+		}
+		queryAuditEvents(ctx, tx, limit, offset)
+	})
+}
+
+func queryAuditEvents(ctx *gin.Context, tx *gorm.DB, limit, offset int) {
+	var events []model.AuditEvent
+	if err := tx.Order("id DESC").Limit(limit).Offset(offset).Find(&events).Error; err != nil {
+		ctx.JSON(http.StatusOK, readErr(err))
+		return
+	}
+	res := make([]AuditEventInfo, 0, len(events))
+	for _, v := range events {
+		res = append(res, auditEventInfo(v))
+	}
+	ctx.JSON(http.StatusOK, resOk(res))
+}
+
+// pagination reads the limit and offset query parameters, responding
+// with an error if they are malformed or out of range.
+func pagination(ctx *gin.Context) (int, int, bool) {
+	limit := 50
+	offset := 0
+	if ctx.Query("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(ctx.Query("limit"))
+		if err != nil || limit <= 0 || limit > 200 {
+			ctx.JSON(http.StatusOK, illegalParams("limit"))
+			return 0, 0, false
+		}
+	}
+	if ctx.Query("offset") != "" {
+		var err error
+		offset, err = strconv.Atoi(ctx.Query("offset"))
+		if err != nil || offset < 0 {
+			ctx.JSON(http.StatusOK, illegalParams("offset"))
+			return 0, 0, false
+		}
+	}
+	return limit, offset, true
+}
+
+// audit appends an event concerning the user with the given id, 0 if
+// unknown. The actor is taken from the authenticated user of the request.
+func audit(ctx *gin.Context, action string, userID uint, success bool, detail string) {
+	event := model.AuditEvent{
+		Action:    action,
+		Success:   success,
+		IP:        ctx.ClientIP(),
+		UserAgent: ctx.Request.UserAgent(),
+		Detail:    detail,
+	}
+	if userID != 0 {
+		event.UserID = &userID
+	}
+	if v, ok := ctx.Get("user"); ok {
+		actor := v.(model.User).ID
+		event.ActorID = &actor
+	}
+	if v, ok := ctx.Get("access_token"); ok {
+		if event.Detail != "" {
+			event.Detail += ", "
+		}
+		event.Detail += "via access token " + v.(model.AccessToken).Name
+	}
+	if err := db.Create(&event).Error; err != nil {
+		log.Printf("Failed to write audit event %s: %v\n", action, err)
+	}
+}
@@ -0,0 +1,203 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const avatarURLPrefix = "/api/avatar/"
+
+// Uploads are cropped to a square and stored in each of these sizes
+var avatarSizes = []int{64, 128, 256}
+
+// Larger images are rejected before decoding them, since a decoded
+// image takes four bytes per pixel however well the upload compressed
+const (
+	avatarMaxDimension = 8192
+	avatarMaxPixels    = 4096 * 4096
+)
+
+var avatarHashReg = regexp.MustCompile("^[0-9a-f]{16}$")
+
+var errInvalidAvatar = errors.New("avatar must be a png, jpeg, gif or webp image")
+
+func EndpointAvatar(ng *gin.Engine) {
+	ng.GET("/api/avatar/:user/:hash", func(ctx *gin.Context) {
+		uid, err := strconv.Atoi(ctx.Param("user"))
+		hash := ctx.Param("hash")
+		if err != nil || !avatarHashReg.MatchString(hash) {
+			ctx.JSON(http.StatusNotFound, resErr(NotFound, "avatar not found"))
+			return
+		}
+		size := avatarSizes[len(avatarSizes)-1]
+		if s, err := strconv.Atoi(ctx.Query("size")); err == nil {
+			for i := len(avatarSizes) - 1; i >= 0 && avatarSizes[i] >= s; i-- {
+				size = avatarSizes[i]
+			}
+		}
+		data, err := avatarStore.Get(avatarKey(uint(uid), hash) + "/" + strconv.Itoa(size) + ".png")
+		if err != nil {
+			ctx.JSON(http.StatusNotFound, resErr(NotFound, "avatar not found"))
+			return
+		}
+		// A new upload always gets a new url
+		ctx.Header("Cache-Control", "public, max-age=31536000, immutable")
+		ctx.Data(http.StatusOK, "image/png", data)
+	})
+
+	g := ng.Group("/api/user/avatar", AuthRequired)
+
+	g.POST("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		maxSize := config.Cfg.Avatar.MaxSize
+		// Leave room for the multipart framing around the file
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, maxSize+64<<10)
+		header, err := ctx.FormFile("avatar")
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(InvalidAvatar, "missing avatar file or file too large"))
+			return
+		}
+		if header.Size > maxSize {
+			ctx.JSON(http.StatusOK, resErr(InvalidAvatar, "avatar file too large"))
+			return
+		}
+		f, err := header.Open()
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(InvalidAvatar, err.Error()))
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+		f.Close()
+		if err != nil || int64(len(data)) > maxSize {
+			ctx.JSON(http.StatusOK, resErr(InvalidAvatar, "avatar file too large"))
+			return
+		}
+		images, err := resizeAvatar(data)
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(InvalidAvatar, err.Error()))
+			return
+		}
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:8])
+		for size, v := range images {
+			if err := avatarStore.Put(avatarKey(user.ID, hash)+"/"+strconv.Itoa(size)+".png", v); err != nil {
+				ctx.JSON(http.StatusOK, writeErr(err))
+				return
+			}
+		}
+		previous := user.Avatar
+		avatar := avatarURLPrefix + strconv.Itoa(int(user.ID)) + "/" + hash
+		if err := db.Model(&user).Update("avatar", avatar).Error; err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		if previous != avatar {
+			removeAvatar(previous)
+		}
+		ctx.JSON(http.StatusOK, resOk(avatar))
+	})
+
+	g.DELETE("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		previous := user.Avatar
+		if err := db.Model(&user).Update("avatar", "").Error; err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		removeAvatar(previous)
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+}
+
+func avatarKey(userID uint, hash string) string {
+	return strconv.Itoa(int(userID)) + "/" + hash
+}
+
+// localAvatar returns avatar if it was uploaded to anniv. Other values
+// stem from the time avatars were arbitrary urls and are hidden, so
+// that clients don't load images from untrusted hosts.
+func localAvatar(avatar string) string {
+	if strings.HasPrefix(avatar, avatarURLPrefix) {
+		return avatar
+	}
+	return ""
+}
+
+// removeAvatar deletes the stored images of an uploaded avatar.
+func removeAvatar(avatar string) {
+	key := strings.TrimPrefix(localAvatar(avatar), avatarURLPrefix)
+	if key == "" || avatarStore == nil {
+		return
+	}
+	if err := avatarStore.Delete(key); err != nil {
+		log.Printf("Failed to remove avatar %s: %v\n", key, err)
+	}
+}
+
+// readAvatar returns the largest stored size of an uploaded avatar.
+func readAvatar(avatar string) ([]byte, error) {
+	key := strings.TrimPrefix(localAvatar(avatar), avatarURLPrefix)
+	if key == "" || avatarStore == nil {
+		return nil, errBlobNotFound
+	}
+	return avatarStore.Get(key + "/" + strconv.Itoa(avatarSizes[len(avatarSizes)-1]) + ".png")
+}
+
+// resizeAvatar decodes an uploaded image, crops it to a centered square
+// and re-encodes it as png in every avatar size.
+func resizeAvatar(data []byte) (map[int][]byte, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidAvatar
+	}
+	switch format {
+	case "png", "jpeg", "gif", "webp":
+	default:
+		return nil, errInvalidAvatar
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width > avatarMaxDimension || cfg.Height > avatarMaxDimension ||
+		cfg.Width*cfg.Height > avatarMaxPixels {
+		return nil, errors.New("avatar dimensions out of range")
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errInvalidAvatar
+	}
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x, y := b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2
+	square := image.Rect(x, y, x+side, y+side)
+
+	res := make(map[int][]byte, len(avatarSizes))
+	for _, size := range avatarSizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, square, draw.Src, nil)
+		buf := bytes.Buffer{}
+		if err := png.Encode(&buf, dst); err != nil {
+			return nil, err
+		}
+		res[size] = buf.Bytes()
+	}
+	return res, nil
+}
@@ -41,9 +41,24 @@ func siteInfo() SiteInfo {
 	} else {
 		features = append(features, "2fa")
 	}
+	if config.Cfg.WebAuthn.Enabled {
+		features = append(features, "webauthn")
+	}
+	if len(config.Cfg.OIDC) != 0 {
+		features = append(features, "oidc")
+	}
+	if config.Cfg.DisablePasswordLogin {
+		features = append(features, "password_login_disabled")
+	}
 	if config.Cfg.RequireInvite {
 		features = append(features, "invite")
 	}
+	if mailEnabled() {
+		features = append(features, "password_reset")
+	}
+	if emailVerificationRequired() {
+		features = append(features, "email_verification")
+	}
 	if meta.DBAvailable() {
 		features = append(features, "metadata-db")
 	}
@@ -0,0 +1,93 @@
+package services
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ProjectAnni/anniv-go/config"
+)
+
+// BlobStore keeps binary objects by key. Keys are slash separated paths
+// made of safe characters only.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	// Delete removes the object at key and every object below it
+	Delete(key string) error
+}
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobStores holds the available backends by name, other backends can
+// register themselves here.
+var blobStores = map[string]func(path string) (BlobStore, error){
+	"local": newLocalBlobStore,
+}
+
+var avatarStore BlobStore
+
+func initBlobStore() error {
+	factory, ok := blobStores[config.Cfg.Avatar.Storage]
+	if !ok {
+		return errors.New("unknown blob store: " + config.Cfg.Avatar.Storage)
+	}
+	var err error
+	avatarStore, err = factory(config.Cfg.Avatar.Path)
+	return err
+}
+
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(path string) (BlobStore, error) {
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{root: path}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	if key == "" || strings.Contains(key, "..") || strings.HasPrefix(key, "/") {
+		return "", errors.New("invalid blob key: " + key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *localBlobStore) Put(key string, data []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+	// Write to a temporary file first so readers never see partial data
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *localBlobStore) Get(key string) ([]byte, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
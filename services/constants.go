@@ -14,17 +14,31 @@ const IllegalParams = 902003
 
 const InvalidNickname = 102000
 const EmailUnavailable = 102001
+const EmailNotVerified = 102002
+const InvalidAvatar = 102003
 const InvalidPassword = 102010
+const LoginAttemptLimited = 102011
+const PasswordLoginDisabled = 102012
+const WeakPassword = 102013
+const MailAttemptLimited = 102014
+const RecentLoginRequired = 102015
 const UserNotExist = 102020
+const UserDisabled = 102021
+const InvalidToken = 102030
+const OIDCFailed = 102040
+const IdentityLinked = 102041
 
 const InvalidPatchCommand = 103003
 
 const ControlledToken = 104002
+const RenewalLimited = 104003
 
 const TFANotEnabled = 202000
 const Wrong2FACode = 202001
 const Illegal2FASecret = 202002
 const TFAAttemptLimited = 202003
 const TFAAlreadyEnabled = 202004
+const WebAuthnFailed = 202010
 
 const InvalidInviteCode = 201001
+const InviteQuotaExceeded = 201002
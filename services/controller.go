@@ -10,7 +10,6 @@ import (
 	"github.com/ProjectAnni/anniv-go/model"
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -18,6 +17,7 @@ import (
 
 var db *gorm.DB
 var migrateTokens = flag.Bool("migrate-tokens", false, "")
+var grantAdmin = flag.String("grant-admin", "", "grant admin role to the user with this email and exit")
 
 func Start(listen string) error {
 	var err error
@@ -25,55 +25,83 @@ func Start(listen string) error {
 	if err != nil {
 		return err
 	}
+	err = model.SetEncryptionKeys(config.Cfg.EncryptionKey, config.Cfg.OldEncryptionKeys)
+	if err != nil {
+		return err
+	}
 	err = model.AutoMigrate(db)
 	if err != nil {
 		return errors.New("failed to migrate db: " + err.Error())
 	}
+	if model.EncryptionEnabled() {
+		n, err := model.ResealColumns(db)
+		if err != nil {
+			return errors.New("failed to encrypt secrets: " + err.Error())
+		}
+		if n != 0 {
+			log.Printf("Sealed %d secrets with the current encryption key.\n", n)
+		}
+	} else {
+		log.Println("No encryption key configured, 2fa secrets and annil tokens are stored in plaintext.")
+	}
 
 	if *migrateTokens {
 		log.Println("Start migrating tokens...")
-		var users []model.User
-		db.Find(&users)
-		for _, user := range users {
-			err := db.Transaction(func(tx *gorm.DB) error {
-				err := tx.Unscoped().Where("user_id=?", user.ID).
-					Where("controlled IS NULL").Delete(&model.Token{}).Error
-				if err != nil {
-					return err
-				}
-				err = tx.Unscoped().Where("user_id=?", user.ID).
-					Where("controlled").Delete(&model.Token{}).Error
-				if err != nil {
-					return err
-				}
-				tokens, err := signUserTokens(user.Email)
-				if err != nil {
-					return err
-				}
-				for _, token := range tokens {
-					err := tx.Create(&model.Token{
-						TokenID:    uuid.NewString(),
-						Name:       token.Name,
-						URL:        token.URL,
-						Token:      token.Token,
-						Priority:   token.Priority,
-						UserID:     user.ID,
-						Controlled: true,
-					}).Error
-					if err != nil {
-						return err
-					}
-				}
-				return nil
-			})
-			if err != nil {
-				log.Fatalf(err.Error())
-			}
+		if err := migrateAllTokens(); err != nil {
+			log.Fatalf(err.Error())
 		}
 		os.Exit(0)
 	}
 
+	if *grantAdmin != "" {
+		res := db.Model(&model.User{}).Where("email = ?", *grantAdmin).Update("role", model.RoleAdmin)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errors.New("user not found: " + *grantAdmin)
+		}
+		log.Printf("Granted admin role to %s.\n", *grantAdmin)
+		os.Exit(0)
+	}
+
+	err = initBlobStore()
+	if err != nil {
+		return errors.New("failed to initialize blob store: " + err.Error())
+	}
+
+	err = purgeDeletedUsers()
+	if err != nil {
+		return errors.New("failed to purge deleted users: " + err.Error())
+	}
+
+	err = migrateInviteCode()
+	if err != nil {
+		return errors.New("failed to migrate invite code: " + err.Error())
+	}
+
+	err = initPasswordPolicy()
+	if err != nil {
+		return errors.New("failed to load breached password list: " + err.Error())
+	}
+
 	initMiddleware()
+	initSessionCleanup()
+	initTokenRenewal()
+
+	err = initWebAuthn()
+	if err != nil {
+		return errors.New("failed to initialize webauthn: " + err.Error())
+	}
+
+	err = initPlaylistIndex()
+	if err != nil {
+		return errors.New("failed to build playlist index: " + err.Error())
+	}
+	err = initLyricIndex()
+	if err != nil {
+		return errors.New("failed to build lyric index: " + err.Error())
+	}
 
 	g := gin.Default()
 	err = g.SetTrustedProxies(config.Cfg.TrustedProxies)
@@ -82,11 +110,23 @@ func Start(listen string) error {
 	}
 
 	g.Use(CustomHeaders)
+	g.Use(CSRFProtection)
 
 	EndpointBasics(g)
 	EndpointUser(g)
+	EndpointAvatar(g)
+	EndpointSession(g)
+	EndpointOIDC(g)
+	EndpointAccessToken(g)
+	EndpointAdmin(g)
+	EndpointAudit(g)
+	EndpointInvite(g)
 	EndpointToken(g)
+	EndpointTokenRenewal(g)
 	Endpoint2FA(g)
+	if config.Cfg.WebAuthn.Enabled {
+		EndpointWebAuthn(g)
+	}
 	EndpointPlaylist(g)
 	if config.Cfg.EnableMeta {
 		EndpointMeta(g)
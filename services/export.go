@@ -0,0 +1,256 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/meta"
+	"github.com/ProjectAnni/anniv-go/model"
+)
+
+type ExportProfile struct {
+	UserInfo
+	InviterID *uint `json:"inviter_id"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+type ExportToken struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	URL        string `json:"url"`
+	Priority   int    `json:"priority"`
+	Controlled bool   `json:"controlled"`
+}
+
+type ExportFavorites struct {
+	Music     []FavoriteMusicEntry    `json:"music"`
+	Albums    []string                `json:"albums"`
+	Playlists []FavoritePlaylistEntry `json:"playlists"`
+}
+
+type ExportShare struct {
+	ID   string          `json:"id"`
+	Date int64           `json:"date"`
+	Info json.RawMessage `json:"info"`
+}
+
+type ExportLyric struct {
+	Track    meta.TrackIdentifier `json:"track"`
+	Language string               `json:"language"`
+	Type     string               `json:"type"`
+	Data     string               `json:"data"`
+	Source   bool                 `json:"source"`
+}
+
+// exportUserData packs everything stored about a user into a zip
+// archive of json files. Secrets such as annil tokens, password hashes
+// and 2fa secrets are left out.
+func exportUserData(user model.User) ([]byte, error) {
+	files := map[string]interface{}{}
+
+	files["profile.json"] = ExportProfile{
+		UserInfo:  userInfo(user),
+		InviterID: user.InviterID,
+		CreatedAt: user.CreatedAt.Unix(),
+	}
+
+	var playlists []model.Playlist
+	if err := db.Where("user_id = ?", user.ID).Find(&playlists).Error; err != nil {
+		return nil, err
+	}
+	playlistDetails := make([]PlaylistDetails, 0, len(playlists))
+	for _, v := range playlists {
+		details, err := queryPlaylist(v)
+		if err != nil {
+			return nil, err
+		}
+		playlistDetails = append(playlistDetails, *details)
+	}
+	files["playlists.json"] = playlistDetails
+
+	favorites := ExportFavorites{
+		Music:     []FavoriteMusicEntry{},
+		Albums:    []string{},
+		Playlists: []FavoritePlaylistEntry{},
+	}
+	var music []model.FavoriteMusic
+	if err := db.Where("user_id = ?", user.ID).Find(&music).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range music {
+		favorites.Music = append(favorites.Music, FavoriteMusicEntry{
+			AlbumID: v.AlbumID,
+			DiscID:  int(v.DiscID),
+			TrackID: int(v.TrackID),
+		})
+	}
+	if err := db.Model(&model.FavoriteAlbum{}).Where("user_id = ?", user.ID).
+		Pluck("album_id", &favorites.Albums).Error; err != nil {
+		return nil, err
+	}
+	var favPlaylists []model.FavoritePlaylist
+	if err := db.Preload("Playlist").Where("user_id = ?", user.ID).Find(&favPlaylists).Error; err != nil {
+		return nil, err
+	}
+	for _, v := range favPlaylists {
+		favorites.Playlists = append(favorites.Playlists, FavoritePlaylistEntry{
+			PlaylistID: strconv.Itoa(int(v.PlaylistID)),
+			Name:       v.Playlist.Name,
+			Owner:      strconv.Itoa(int(v.Playlist.UserID)),
+		})
+	}
+	files["favorites.json"] = favorites
+
+	var records []model.PlayRecord
+	if err := db.Where("user_id = ?", user.ID).Order("at").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	history := make([]HistoryRecord, 0, len(records))
+	for _, v := range records {
+		history = append(history, HistoryRecord{Track: v.Track, At: v.At.Unix()})
+	}
+	files["play_records.json"] = history
+
+	var shares []model.Share
+	if err := db.Where("user_id = ?", user.ID).Find(&shares).Error; err != nil {
+		return nil, err
+	}
+	shareEntries := make([]ExportShare, 0, len(shares))
+	for _, v := range shares {
+		shareEntries = append(shareEntries, ExportShare{
+			ID:   v.ShareID,
+			Date: v.CreatedAt.Unix(),
+			Info: v.Info,
+		})
+	}
+	files["shares.json"] = shareEntries
+
+	var lyrics []model.Lyric
+	if err := db.Where("user_id = ?", user.ID).Find(&lyrics).Error; err != nil {
+		return nil, err
+	}
+	lyricEntries := make([]ExportLyric, 0, len(lyrics))
+	for _, v := range lyrics {
+		lyricEntries = append(lyricEntries, ExportLyric{
+			Track: meta.TrackIdentifier{
+				DiscIdentifier: meta.DiscIdentifier{
+					AlbumID: meta.AlbumIdentifier(v.AlbumID),
+					DiscID:  uint(v.DiscID),
+				},
+				TrackID: uint(v.TrackID),
+			},
+			Language: v.Language,
+			Type:     v.Type,
+			Data:     v.Data,
+			Source:   v.Source,
+		})
+	}
+	files["lyrics.json"] = lyricEntries
+
+	var tokens []model.Token
+	if err := db.Where("user_id = ?", user.ID).Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	tokenEntries := make([]ExportToken, 0, len(tokens))
+	for _, v := range tokens {
+		tokenEntries = append(tokenEntries, ExportToken{
+			ID:         v.TokenID,
+			Name:       v.Name,
+			URL:        v.URL,
+			Priority:   v.Priority,
+			Controlled: v.Controlled,
+		})
+	}
+	files["tokens.json"] = tokenEntries
+
+	var sessions []model.Session
+	if err := db.Where("user_id = ?", user.ID).Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	sessionEntries := make([]SessionInfo, 0, len(sessions))
+	for _, v := range sessions {
+		sessionEntries = append(sessionEntries, sessionInfo(v, false))
+	}
+	files["sessions.json"] = sessionEntries
+
+	var identities []model.UserIdentity
+	if err := db.Where("user_id = ?", user.ID).Find(&identities).Error; err != nil {
+		return nil, err
+	}
+	identityEntries := make([]UserIdentityInfo, 0, len(identities))
+	for _, v := range identities {
+		identityEntries = append(identityEntries, userIdentityInfo(v))
+	}
+	files["identities.json"] = identityEntries
+
+	var accessTokens []model.AccessToken
+	if err := db.Where("user_id = ?", user.ID).Find(&accessTokens).Error; err != nil {
+		return nil, err
+	}
+	accessTokenEntries := make([]AccessTokenInfo, 0, len(accessTokens))
+	for _, v := range accessTokens {
+		accessTokenEntries = append(accessTokenEntries, accessTokenInfo(v))
+	}
+	files["access_tokens.json"] = accessTokenEntries
+
+	var credentials []model.WebAuthnCredential
+	if err := db.Where("user_id = ?", user.ID).Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	credentialEntries := make([]WebAuthnCredentialInfo, 0, len(credentials))
+	for _, v := range credentials {
+		credentialEntries = append(credentialEntries, webAuthnCredentialInfo(v))
+	}
+	files["passkeys.json"] = credentialEntries
+
+	var invites []model.Invite
+	if err := db.Where("creator_id = ?", user.ID).Find(&invites).Error; err != nil {
+		return nil, err
+	}
+	inviteEntries := make([]InviteInfo, 0, len(invites))
+	for _, v := range invites {
+		inviteEntries = append(inviteEntries, inviteInfo(v))
+	}
+	files["invites.json"] = inviteEntries
+
+	var events []model.AuditEvent
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	eventEntries := make([]AuditEventInfo, 0, len(events))
+	for _, v := range events {
+		eventEntries = append(eventEntries, auditEventInfo(v))
+	}
+	files["audit_events.json"] = eventEntries
+
+	buf := bytes.Buffer{}
+	w := zip.NewWriter(&buf)
+	now := time.Now()
+	for name, v := range files {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: now})
+		if err != nil {
+			return nil, err
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	if avatar, err := readAvatar(user.Avatar); err == nil {
+		f, err := w.CreateHeader(&zip.FileHeader{Name: "avatar.png", Method: zip.Store, Modified: now})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(avatar); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var errInviteUsedUp = errors.New("invite code used up")
+
+func EndpointInvite(ng *gin.Engine) {
+	g := ng.Group("/api/invite", AuthRequired)
+
+	g.GET("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		var invites []model.Invite
+		if err := db.Where("creator_id = ?", user.ID).Order("created_at DESC").
+			Find(&invites).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		res := make([]InviteInfo, 0, len(invites))
+		for _, v := range invites {
+			res = append(res, inviteInfo(v))
+		}
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	g.POST("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := CreateInviteForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed invite form"))
+			return
+		}
+		if form.MaxUses == 0 {
+			form.MaxUses = 1
+		}
+		if form.MaxUses < 0 || form.ExpiresIn < 0 {
+			ctx.JSON(http.StatusOK, illegalParams("malformed invite form"))
+			return
+		}
+		if user.Role != model.RoleAdmin {
+			used, err := usedInviteQuota(user)
+			if err != nil {
+				ctx.JSON(http.StatusOK, readErr(err))
+				return
+			}
+			if used+form.MaxUses > config.Cfg.InviteQuota {
+				ctx.JSON(http.StatusOK, resErr(InviteQuotaExceeded, "invite quota exceeded"))
+				return
+			}
+		}
+		code, err := newInviteCode()
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(InternalError, err.Error()))
+			return
+		}
+		invite := model.Invite{
+			Code:      code,
+			CreatorID: user.ID,
+			MaxUses:   form.MaxUses,
+		}
+		if form.ExpiresIn != 0 {
+			expires := time.Now().Add(time.Duration(form.ExpiresIn) * time.Second)
+			invite.ExpiresAt = &expires
+		}
+		if err := db.Save(&invite).Error; err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(inviteInfo(invite)))
+	})
+
+	g.DELETE("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := DeleteForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed delete form"))
+			return
+		}
+		invite := model.Invite{}
+		if err := db.Where("code = ?", form.ID).First(&invite).Error; err != nil {
+			ctx.JSON(http.StatusOK, resErr(NotFound, "invite not found"))
+			return
+		}
+		if invite.CreatorID != user.ID && user.Role != model.RoleAdmin {
+			ctx.JSON(http.StatusOK, resErr(PermissionDenied, "this invite does not belong to you"))
+			return
+		}
+		// soft delete, so that the invite tree can still refer to it
+		if err := db.Delete(&invite).Error; err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.GET("/tree", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		var users []model.User
+		if err := db.Select("id", "nickname", "avatar", "inviter_id", "created_at").
+			Find(&users).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		exists := make(map[uint]bool, len(users))
+		for _, v := range users {
+			exists[v.ID] = true
+		}
+		children := make(map[uint][]model.User)
+		var roots []model.User
+		for _, v := range users {
+			// users whose inviter was deleted become roots as well
+			if v.InviterID == nil || !exists[*v.InviterID] {
+				roots = append(roots, v)
+			} else {
+				children[*v.InviterID] = append(children[*v.InviterID], v)
+			}
+		}
+		if user.Role == model.RoleAdmin {
+			res := make([]InviteTreeNode, 0, len(roots))
+			for _, v := range roots {
+				res = append(res, inviteTree(v, children))
+			}
+			ctx.JSON(http.StatusOK, resOk(res))
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk([]InviteTreeNode{inviteTree(user, children)}))
+	})
+}
+
+// newInviteCode returns an unguessable invite code of 16 random bytes.
+func newInviteCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func inviteTree(user model.User, children map[uint][]model.User) InviteTreeNode {
+	node := InviteTreeNode{
+		UserIntro: userIntro(user),
+		JoinedAt:  user.CreatedAt.Unix(),
+		Invited:   make([]InviteTreeNode, 0, len(children[user.ID])),
+	}
+	for _, v := range children[user.ID] {
+		node.Invited = append(node.Invited, inviteTree(v, children))
+	}
+	return node
+}
+
+// usedInviteQuota counts the registrations a user has handed out:
+// every seat of a still valid code, but only the used ones of expired,
+// exhausted or deleted codes.
+func usedInviteQuota(user model.User) (int, error) {
+	var invites []model.Invite
+	if err := db.Unscoped().Where("creator_id = ?", user.ID).Find(&invites).Error; err != nil {
+		return 0, err
+	}
+	used := 0
+	for _, v := range invites {
+		if v.DeletedAt.Valid || inviteExpired(v) {
+			used += v.Uses
+		} else {
+			used += v.MaxUses
+		}
+	}
+	return used, nil
+}
+
+func inviteExpired(invite model.Invite) bool {
+	return invite.ExpiresAt != nil && invite.ExpiresAt.Before(time.Now())
+}
+
+// findInvite looks up a valid invite code.
+func findInvite(code string) (invite *model.Invite, ok bool) {
+	if code == "" {
+		return nil, false
+	}
+	invite = &model.Invite{}
+	if err := db.Where("code = ?", code).First(invite).Error; err != nil {
+		return nil, false
+	}
+	if inviteExpired(*invite) || invite.Uses >= invite.MaxUses {
+		return nil, false
+	}
+	return invite, true
+}
+
+// migrateInviteCode turns the invite code from the config, which used
+// to be accepted any number of times, into a regular invite owned by
+// the first admin and removes it from the config.
+func migrateInviteCode() error {
+	code := config.Cfg.InviteCode
+	if code == "" {
+		return nil
+	}
+	silent := db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})
+	admin := model.User{}
+	if silent.Where("role = ?", model.RoleAdmin).Order("id").First(&admin).RowsAffected == 0 {
+		log.Println("The invite code in the config is ignored until there is an admin to own it.")
+		return nil
+	}
+	if silent.Unscoped().Where("code = ?", code).First(&model.Invite{}).RowsAffected == 0 {
+		invite := model.Invite{
+			Code:      code,
+			CreatorID: admin.ID,
+			MaxUses:   config.Cfg.InviteCodeMaxUses,
+		}
+		if err := db.Create(&invite).Error; err != nil {
+			return err
+		}
+		log.Printf("Moved the invite code in the config into an invite of %s with %d uses.\n",
+			admin.Email, invite.MaxUses)
+	}
+	config.Cfg.InviteCode = ""
+	return config.Save()
+}
+
+// consumeInvite takes one use of invite for user inside tx.
+func consumeInvite(tx *gorm.DB, invite *model.Invite, user *model.User) error {
+	res := tx.Model(&model.Invite{}).
+		Where("id = ? AND uses < max_uses", invite.ID).
+		Update("uses", gorm.Expr("uses + 1"))
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected != 1 {
+		return errInviteUsedUp
+	}
+	user.InviterID = &invite.CreatorID
+	user.InviteID = &invite.ID
+	return nil
+}
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/model"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTestDB points db at a fresh in-memory database for one test.
+func setupTestDB(t *testing.T) {
+	conn, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := conn.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection would open its own in-memory database
+	sqlDB.SetMaxOpenConns(1)
+	if err := model.AutoMigrate(conn); err != nil {
+		t.Fatal(err)
+	}
+	old := db
+	db = conn
+	t.Cleanup(func() {
+		db = old
+		_ = sqlDB.Close()
+	})
+}
+
+func createTestUser(t *testing.T, email string) model.User {
+	user := model.User{Email: email, Nickname: email}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestFindInvite(t *testing.T) {
+	setupTestDB(t)
+	creator := createTestUser(t, "creator@example.com")
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	invites := []model.Invite{
+		{Code: "valid", MaxUses: 1},
+		{Code: "unexpired", MaxUses: 3, Uses: 2, ExpiresAt: &future},
+		{Code: "expired", MaxUses: 1, ExpiresAt: &past},
+		{Code: "used-up", MaxUses: 2, Uses: 2},
+		{Code: "deleted", MaxUses: 1},
+	}
+	for i := range invites {
+		invites[i].CreatorID = creator.ID
+		if err := db.Create(&invites[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Delete(&invites[4])
+
+	tests := []struct {
+		code string
+		ok   bool
+	}{
+		{"valid", true},
+		{"unexpired", true},
+		{"expired", false},
+		{"used-up", false},
+		{"deleted", false},
+		{"unknown", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		invite, ok := findInvite(tt.code)
+		if ok != tt.ok {
+			t.Errorf("findInvite(%q) ok = %v, want %v", tt.code, ok, tt.ok)
+		}
+		if ok && invite.Code != tt.code {
+			t.Errorf("findInvite(%q) found %q", tt.code, invite.Code)
+		}
+	}
+}
+
+func TestConsumeInvite(t *testing.T) {
+	setupTestDB(t)
+	creator := createTestUser(t, "creator@example.com")
+	invite := model.Invite{Code: "code", CreatorID: creator.ID, MaxUses: 2}
+	if err := db.Create(&invite).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email string
+		err   error
+	}{
+		{"first@example.com", nil},
+		{"second@example.com", nil},
+		{"third@example.com", errInviteUsedUp},
+	}
+	for _, tt := range tests {
+		user := model.User{Email: tt.email}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			return consumeInvite(tx, &invite, &user)
+		})
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: consumeInvite error = %v, want %v", tt.email, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if user.InviterID == nil || *user.InviterID != creator.ID || user.InviteID == nil || *user.InviteID != invite.ID {
+			t.Errorf("%s: inviter %v, invite %v not recorded", tt.email, user.InviterID, user.InviteID)
+		}
+	}
+	db.First(&invite, invite.ID)
+	if invite.Uses != 2 {
+		t.Errorf("invite used %d times, want 2", invite.Uses)
+	}
+	if _, ok := findInvite("code"); ok {
+		t.Error("used up invite is still valid")
+	}
+}
+
+func TestUsedInviteQuota(t *testing.T) {
+	setupTestDB(t)
+	creator := createTestUser(t, "creator@example.com")
+	other := createTestUser(t, "other@example.com")
+	past := time.Now().Add(-time.Hour)
+	invites := []model.Invite{
+		// open seats of valid codes count in full
+		{Code: "a", CreatorID: creator.ID, MaxUses: 3, Uses: 1},
+		// expired and deleted codes only count their uses
+		{Code: "b", CreatorID: creator.ID, MaxUses: 5, Uses: 2, ExpiresAt: &past},
+		{Code: "c", CreatorID: creator.ID, MaxUses: 4, Uses: 1},
+		{Code: "d", CreatorID: other.ID, MaxUses: 10},
+	}
+	for i := range invites {
+		if err := db.Create(&invites[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Delete(&invites[2])
+
+	tests := []struct {
+		user model.User
+		want int
+	}{
+		{creator, 3 + 2 + 1},
+		{other, 10},
+		{model.User{Model: gorm.Model{ID: 999}}, 0},
+	}
+	for _, tt := range tests {
+		got, err := usedInviteQuota(tt.user)
+		if err != nil || got != tt.want {
+			t.Errorf("usedInviteQuota(%s) = %d, %v, want %d", tt.user.Email, got, err, tt.want)
+		}
+	}
+}
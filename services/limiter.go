@@ -0,0 +1,163 @@
+package services
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+)
+
+// attemptLimiter tracks failed authentication attempts per key. Once a
+// key has used up its free attempts, every further failure locks it for
+// twice as long as the previous one, up to the configured maximum.
+type attemptLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*attemptEntry
+}
+
+type attemptEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+var authLimiter = &attemptLimiter{entries: make(map[string]*attemptEntry)}
+
+func ipLimitKey(ip string) string {
+	return "ip:" + ip
+}
+
+func accountLimitKey(email string) string {
+	return "account:" + strings.ToLower(email)
+}
+
+func tfaLimitKey(userID uint) string {
+	return "2fa:" + strconv.Itoa(int(userID))
+}
+
+// locked returns how long the longest lockout among keys still lasts.
+func (l *attemptLimiter) locked(keys ...string) time.Duration {
+	if !config.Cfg.LoginLimit.Enabled {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var res time.Duration
+	for _, k := range keys {
+		if e, ok := l.entries[k]; ok && e.lockedUntil.After(now) {
+			if d := e.lockedUntil.Sub(now); d > res {
+				res = d
+			}
+		}
+	}
+	return res
+}
+
+// fail records a failed attempt for key, which gets locked once it has
+// reached threshold failures.
+func (l *attemptLimiter) fail(key string, threshold int) {
+	cfg := config.Cfg.LoginLimit
+	if !cfg.Enabled {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	e, ok := l.entries[key]
+	if !ok || now.Sub(e.lastFailure) > cfg.ResetAfter {
+		e = &attemptEntry{}
+		l.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = now
+	if e.failures < threshold {
+		return
+	}
+	lockout := cfg.BaseLockout
+	for i := threshold; i < e.failures && lockout < cfg.MaxLockout; i++ {
+		lockout *= 2
+	}
+	if lockout > cfg.MaxLockout {
+		lockout = cfg.MaxLockout
+	}
+	e.lockedUntil = now.Add(lockout)
+}
+
+func (l *attemptLimiter) reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, key)
+}
+
+// prune drops entries which are neither locked nor recent enough to
+// count towards a lockout.
+func (l *attemptLimiter) prune() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, e := range l.entries {
+		if now.After(e.lockedUntil) && now.Sub(e.lastFailure) > config.Cfg.LoginLimit.ResetAfter {
+			delete(l.entries, k)
+		}
+	}
+}
+
+// cooldown lets an action run at most once per period for each key,
+// for actions which are expensive even when they succeed.
+type cooldown struct {
+	mu   sync.Mutex
+	next map[string]time.Time
+}
+
+// cooldowns are pruned together with the attempt limiter.
+var cooldowns []*cooldown
+
+func newCooldown() *cooldown {
+	c := &cooldown{next: make(map[string]time.Time)}
+	cooldowns = append(cooldowns, c)
+	return c
+}
+
+// take returns how long the longest wait among keys still lasts. If
+// there is none, the action is recorded for every key.
+func (c *cooldown) take(period time.Duration, keys ...string) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var res time.Duration
+	for _, k := range keys {
+		if t, ok := c.next[k]; ok && t.After(now) && t.Sub(now) > res {
+			res = t.Sub(now)
+		}
+	}
+	if res > 0 {
+		return res
+	}
+	for _, k := range keys {
+		c.next[k] = now.Add(period)
+	}
+	return 0
+}
+
+func (c *cooldown) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, t := range c.next {
+		if !t.After(now) {
+			delete(c.next, k)
+		}
+	}
+}
+
+func attemptLimited(status int, d time.Duration) Response {
+	seconds := int(d.Seconds()) + 1
+	return Response{
+		Status:  status,
+		Message: "too many attempts, retry after " + strconv.Itoa(seconds) + "s",
+		Data:    map[string]int{"retry_after": seconds},
+	}
+}
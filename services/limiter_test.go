@@ -0,0 +1,105 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+)
+
+func setLoginLimit(t *testing.T, cfg config.LoginLimitConfig) {
+	old := config.Cfg.LoginLimit
+	config.Cfg.LoginLimit = cfg
+	t.Cleanup(func() { config.Cfg.LoginLimit = old })
+}
+
+var testLoginLimit = config.LoginLimitConfig{
+	Enabled:     true,
+	BaseLockout: time.Minute,
+	MaxLockout:  time.Hour,
+	ResetAfter:  24 * time.Hour,
+}
+
+func TestAttemptLimiterBackoff(t *testing.T) {
+	setLoginLimit(t, testLoginLimit)
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{8, 32 * time.Minute},
+		{9, time.Hour},
+		{30, time.Hour},
+	}
+	for _, tt := range tests {
+		l := &attemptLimiter{entries: make(map[string]*attemptEntry)}
+		for i := 0; i < tt.failures; i++ {
+			l.fail("k", 3)
+		}
+		if got := l.locked("k"); !lockedAbout(got, tt.want) {
+			t.Errorf("after %d failures locked for %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+// lockedAbout reports whether a remaining lockout of got is what is left
+// of want right after it was set.
+func lockedAbout(got, want time.Duration) bool {
+	if want == 0 {
+		return got == 0
+	}
+	return got <= want && got > want-time.Second
+}
+
+func TestAttemptLimiterKeys(t *testing.T) {
+	setLoginLimit(t, testLoginLimit)
+	l := &attemptLimiter{entries: make(map[string]*attemptEntry)}
+	for i := 0; i < 4; i++ {
+		l.fail("a", 3)
+	}
+	l.fail("b", 1)
+	if d := l.locked("b", "a", "c"); !lockedAbout(d, 2*time.Minute) {
+		t.Errorf("locked = %v, want the longest lockout of 2m", d)
+	}
+	if d := l.locked("c"); d != 0 {
+		t.Errorf("unknown key locked for %v", d)
+	}
+	l.reset("a")
+	if d := l.locked("a"); d != 0 {
+		t.Errorf("reset key locked for %v", d)
+	}
+}
+
+func TestAttemptLimiterResetAfter(t *testing.T) {
+	setLoginLimit(t, testLoginLimit)
+	l := &attemptLimiter{entries: make(map[string]*attemptEntry)}
+	l.fail("k", 3)
+	l.fail("k", 3)
+	l.entries["k"].lastFailure = time.Now().Add(-25 * time.Hour)
+	l.fail("k", 3)
+	if d := l.locked("k"); d != 0 {
+		t.Errorf("stale failures counted, locked for %v", d)
+	}
+	l.entries["k"].lastFailure = time.Now().Add(-25 * time.Hour)
+	l.prune()
+	if _, ok := l.entries["k"]; ok {
+		t.Error("stale entry not pruned")
+	}
+}
+
+func TestAttemptLimiterDisabled(t *testing.T) {
+	cfg := testLoginLimit
+	cfg.Enabled = false
+	setLoginLimit(t, cfg)
+	l := &attemptLimiter{entries: make(map[string]*attemptEntry)}
+	for i := 0; i < 10; i++ {
+		l.fail("k", 1)
+	}
+	if d := l.locked("k"); d != 0 {
+		t.Errorf("disabled limiter locked for %v", d)
+	}
+}
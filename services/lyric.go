@@ -68,7 +68,7 @@ func EndpointLyric(ng *gin.Engine) {
 					Language: form.Lang,
 					Type:     form.Type,
 					Data:     form.Data,
-					UserID:   user.ID,
+					UserID:   &user.ID,
 					Source:   true,
 				}
 				return tx.Save(&lyric).Error
@@ -86,7 +86,7 @@ func EndpointLyric(ng *gin.Engine) {
 				Language: form.Lang,
 				Type:     form.Type,
 				Data:     form.Data,
-				UserID:   user.ID,
+				UserID:   &user.ID,
 				Source:   false,
 			}
 			return tx.Save(&lyric).Error
@@ -95,6 +95,7 @@ func EndpointLyric(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		reindexLyrics(form.AlbumID, form.DiscID, form.TrackID)
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 }
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/meta"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/lang/cjk"
+)
+
+type LyricMatch struct {
+	Track    meta.TrackIdentifier `json:"track"`
+	Language string               `json:"language"`
+	Line     string               `json:"line"`
+	// Offset of the line in milliseconds, absent for plain text lyrics
+	Time *int64 `json:"time,omitempty"`
+}
+
+type lyricLineDoc struct {
+	Text     string  `json:"text"`
+	Lyric    string  `json:"lyric"`
+	AlbumID  string  `json:"album_id"`
+	DiscID   float64 `json:"disc_id"`
+	TrackID  float64 `json:"track_id"`
+	Language string  `json:"language"`
+	Time     float64 `json:"time"`
+}
+
+type lyricLine struct {
+	Time int64
+	Text string
+}
+
+var lyricIdx bleve.Index
+
+var lrcTimeTag = regexp.MustCompile(`^\[(\d+):(\d+)(?:[.:](\d+))?]`)
+var lrcWordTag = regexp.MustCompile(`<\d+:\d+(?:[.:]\d+)?>`)
+var lrcMetaTag = regexp.MustCompile(`^\[[a-zA-Z#]+:.*]$`)
+
+// parseLyricLines splits lyric data into lines. For lrc lyrics the
+// timestamps are stripped and returned separately in milliseconds,
+// other lines get a time of -1.
+func parseLyricLines(typ, data string) []lyricLine {
+	var res []lyricLine
+	for _, raw := range strings.Split(data, "\n") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if typ != "lrc" {
+			res = append(res, lyricLine{Time: -1, Text: raw})
+			continue
+		}
+		var times []int64
+		for {
+			m := lrcTimeTag.FindStringSubmatch(raw)
+			if m == nil {
+				break
+			}
+			min, _ := strconv.ParseInt(m[1], 10, 64)
+			sec, _ := strconv.ParseInt(m[2], 10, 64)
+			ms := int64(0)
+			if m[3] != "" {
+				frac := (m[3] + "00")[:3]
+				ms, _ = strconv.ParseInt(frac, 10, 64)
+			}
+			times = append(times, (min*60+sec)*1000+ms)
+			raw = raw[len(m[0]):]
+		}
+		if len(times) == 0 && lrcMetaTag.MatchString(raw) {
+			continue
+		}
+		text := strings.TrimSpace(lrcWordTag.ReplaceAllString(raw, ""))
+		if text == "" {
+			continue
+		}
+		if len(times) == 0 {
+			times = append(times, -1)
+		}
+		for _, t := range times {
+			res = append(res, lyricLine{Time: t, Text: text})
+		}
+	}
+	return res
+}
+
+func initLyricIndex() error {
+	log.Println("Building lyric search index...")
+	start := time.Now()
+
+	// Most lyrics are Japanese or Chinese, which the standard analyzer
+	// can't split into words. The cjk analyzer indexes bigrams instead.
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = cjk.AnalyzerName
+	kw := bleve.NewTextFieldMapping()
+	kw.Analyzer = keyword.Name
+	num := bleve.NewNumericFieldMapping()
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("text", text)
+	doc.AddFieldMappingsAt("lyric", kw)
+	doc.AddFieldMappingsAt("album_id", kw)
+	doc.AddFieldMappingsAt("disc_id", num)
+	doc.AddFieldMappingsAt("track_id", num)
+	doc.AddFieldMappingsAt("language", kw)
+	doc.AddFieldMappingsAt("time", num)
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+
+	var err error
+	lyricIdx, err = bleve.New("", m)
+	if err != nil {
+		return err
+	}
+
+	var lyrics []model.Lyric
+	if err := db.Find(&lyrics).Error; err != nil {
+		return err
+	}
+	batch := lyricIdx.NewBatch()
+	for _, v := range lyrics {
+		for idx, line := range parseLyricLines(v.Type, v.Data) {
+			if err := batch.Index(lyricLineID(v.ID, idx), newLyricLineDoc(v, line)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := lyricIdx.Batch(batch); err != nil {
+		return err
+	}
+
+	log.Printf("Done, took %d ms.\n", time.Now().Sub(start).Milliseconds())
+	return nil
+}
+
+func lyricLineID(lyricID uint, line int) string {
+	return strconv.Itoa(int(lyricID)) + ":" + strconv.Itoa(line)
+}
+
+func newLyricLineDoc(l model.Lyric, line lyricLine) lyricLineDoc {
+	return lyricLineDoc{
+		Text:     line.Text,
+		Lyric:    strconv.Itoa(int(l.ID)),
+		AlbumID:  l.AlbumID,
+		DiscID:   float64(l.DiscID),
+		TrackID:  float64(l.TrackID),
+		Language: l.Language,
+		Time:     float64(line.Time),
+	}
+}
+
+// reindexLyrics replaces the indexed lines of every lyric of a track.
+// Failures are only logged, since the lyrics have already been written.
+func reindexLyrics(albumID string, discID, trackID int) {
+	var lyrics []model.Lyric
+	if err := db.Where("album_id = ? AND disc_id = ? AND track_id = ?", albumID, discID, trackID).
+		Find(&lyrics).Error; err != nil {
+		log.Printf("Failed to reindex lyrics of %s/%d/%d: %v\n", albumID, discID, trackID, err)
+		return
+	}
+	for _, v := range lyrics {
+		if err := unindexLyric(v.ID); err != nil {
+			log.Printf("Failed to unindex lyric %d: %v\n", v.ID, err)
+			continue
+		}
+		batch := lyricIdx.NewBatch()
+		for idx, line := range parseLyricLines(v.Type, v.Data) {
+			if err := batch.Index(lyricLineID(v.ID, idx), newLyricLineDoc(v, line)); err != nil {
+				log.Printf("Failed to index lyric %d: %v\n", v.ID, err)
+			}
+		}
+		if err := lyricIdx.Batch(batch); err != nil {
+			log.Printf("Failed to index lyric %d: %v\n", v.ID, err)
+		}
+	}
+}
+
+func unindexLyric(id uint) error {
+	q := bleve.NewTermQuery(strconv.Itoa(int(id)))
+	q.SetField("lyric")
+	for {
+		search := bleve.NewSearchRequestOptions(q, 1000, 0, false)
+		res, err := lyricIdx.Search(search)
+		if err != nil {
+			return err
+		}
+		if len(res.Hits) == 0 {
+			return nil
+		}
+		batch := lyricIdx.NewBatch()
+		for _, v := range res.Hits {
+			batch.Delete(v.ID)
+		}
+		if err := lyricIdx.Batch(batch); err != nil {
+			return err
+		}
+	}
+}
+
+// searchLyrics finds lyric lines matching keyword, returning the best
+// matching line of each track. offset counts tracks, not lines.
+func searchLyrics(keyword string, limit, offset int) ([]LyricMatch, error) {
+	q := bleve.NewMatchQuery(keyword)
+	q.SetField("text")
+	search := bleve.NewSearchRequestOptions(q, (offset+limit)*4, 0, false)
+	search.Fields = []string{"text", "album_id", "disc_id", "track_id", "language", "time"}
+	res, err := lyricIdx.Search(search)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := make([]LyricMatch, 0, limit)
+	seen := make(map[meta.TrackIdentifier]bool)
+	for _, hit := range res.Hits {
+		albumID, _ := hit.Fields["album_id"].(string)
+		discID, _ := hit.Fields["disc_id"].(float64)
+		trackID, _ := hit.Fields["track_id"].(float64)
+		track := meta.TrackIdentifier{
+			DiscIdentifier: meta.DiscIdentifier{
+				AlbumID: meta.AlbumIdentifier(albumID),
+				DiscID:  uint(discID),
+			},
+			TrackID: uint(trackID),
+		}
+		if seen[track] {
+			continue
+		}
+		seen[track] = true
+		if len(seen) <= offset {
+			continue
+		}
+		match := LyricMatch{Track: track}
+		match.Language, _ = hit.Fields["language"].(string)
+		match.Line, _ = hit.Fields["text"].(string)
+		if t, ok := hit.Fields["time"].(float64); ok && t >= 0 {
+			ms := int64(t)
+			match.Time = &ms
+		}
+		matches = append(matches, match)
+		if len(matches) >= limit {
+			break
+		}
+	}
+	return matches, nil
+}
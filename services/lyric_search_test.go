@@ -0,0 +1,47 @@
+package services
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLyricLines(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  string
+		data string
+		want []lyricLine
+	}{
+		{"text", "text", "first line\n\n  second line  \r\n", []lyricLine{
+			{-1, "first line"},
+			{-1, "second line"},
+		}},
+		{"text keeps brackets", "text", "[00:01.00]not a timestamp", []lyricLine{
+			{-1, "[00:01.00]not a timestamp"},
+		}},
+		{"centiseconds", "lrc", "[00:01.23]a\n[01:02.50]b", []lyricLine{
+			{1230, "a"},
+			{62500, "b"},
+		}},
+		{"milliseconds", "lrc", "[00:01.234]a", []lyricLine{{1234, "a"}}},
+		{"tenths", "lrc", "[00:01.5]a", []lyricLine{{1500, "a"}}},
+		{"colon separator", "lrc", "[00:01:50]a", []lyricLine{{1500, "a"}}},
+		{"no fraction", "lrc", "[02:03]a", []lyricLine{{123000, "a"}}},
+		{"long minutes", "lrc", "[100:00.00]a", []lyricLine{{6000000, "a"}}},
+		{"repeated line", "lrc", "[00:01.00][00:30.00]chorus", []lyricLine{
+			{1000, "chorus"},
+			{30000, "chorus"},
+		}},
+		{"metadata", "lrc", "[ti:Connect]\n[ar:ClariS]\n[offset:+100]\n[00:01.00]a", []lyricLine{{1000, "a"}}},
+		{"word timing", "lrc", "[00:01.00]<00:01.00>co<00:01.50>nnect", []lyricLine{{1000, "connect"}}},
+		{"empty timed line", "lrc", "[00:01.00]\n[00:02.00]  ", nil},
+		{"untimed line", "lrc", "plain", []lyricLine{{-1, "plain"}}},
+		{"cjk", "lrc", "[00:12.34]君の銀の庭", []lyricLine{{12340, "君の銀の庭"}}},
+	}
+	for _, tt := range tests {
+		got := parseLyricLines(tt.typ, tt.data)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseLyricLines = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package services
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/gin-gonic/gin"
+)
+
+//go:embed templates/mail/*.tmpl
+var mailTemplateFiles embed.FS
+
+var mailTemplates = template.Must(template.ParseFS(mailTemplateFiles, "templates/mail/*.tmpl"))
+
+type MailData struct {
+	SiteName  string
+	Nickname  string
+	Email     string
+	Link      string
+	ExpiresIn string
+}
+
+// Anyone can ask for verification and reset mails, so they are limited
+// per client and per address
+const (
+	mailIPCooldown      = 10 * time.Second
+	mailAddressCooldown = 2 * time.Minute
+)
+
+var (
+	mailIPLimiter      = newCooldown()
+	mailAddressLimiter = newCooldown()
+)
+
+func mailEnabled() bool {
+	return config.Cfg.SMTP.Enabled
+}
+
+func emailVerificationRequired() bool {
+	return config.Cfg.SMTP.Enabled && config.Cfg.RequireEmailVerification
+}
+
+// sendMail renders the named template and sends it to the given address.
+func sendMail(to, name string, data MailData) error {
+	data.SiteName = config.Cfg.SiteName
+	var subject, body bytes.Buffer
+	if err := mailTemplates.ExecuteTemplate(&subject, name+".subject", data); err != nil {
+		return err
+	}
+	if err := mailTemplates.ExecuteTemplate(&body, name+".body", data); err != nil {
+		return err
+	}
+
+	cfg := config.Cfg.SMTP
+	msg := bytes.Buffer{}
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject.String()))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	msg.Write(bytes.ReplaceAll(body.Bytes(), []byte("\n"), []byte("\r\n")))
+
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	addr := cfg.Host + ":" + strconv.Itoa(cfg.Port)
+	return smtp.SendMail(addr, auth, cfg.From, []string{to}, msg.Bytes())
+}
+
+// mailAllowed throttles endpoints sending mails to an address given by
+// an anonymous client, responding itself if no mail may be sent. An
+// address mailed too recently gets the usual response, so that it isn't
+// revealed whether it is registered.
+func mailAllowed(ctx *gin.Context, email string) bool {
+	if d := mailIPLimiter.take(mailIPCooldown, ipLimitKey(ctx.ClientIP())); d > 0 {
+		ctx.JSON(http.StatusOK, attemptLimited(MailAttemptLimited, d))
+		return false
+	}
+	if mailAddressLimiter.take(mailAddressCooldown, accountLimitKey(email)) > 0 {
+		ctx.JSON(http.StatusOK, resOk(nil))
+		return false
+	}
+	return true
+}
+
+// sendMailAsync sends a mail in the background, so that slow mail
+// servers don't block requests. Failures are only logged.
+func sendMailAsync(to, name string, data MailData) {
+	go func() {
+		if err := sendMail(to, name, data); err != nil {
+			log.Printf("Failed to send %s mail to %s: %v\n", name, to, err)
+		}
+	}()
+}
@@ -1,18 +1,25 @@
 package services
 
 import (
+	"bytes"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/ProjectAnni/anniv-go/config"
 	"github.com/ProjectAnni/anniv-go/model"
 	"github.com/gin-gonic/gin"
-	"github.com/pquerna/otp/totp"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
 func AuthRequired(ctx *gin.Context) {
+	if token, ok := bearerToken(ctx); ok {
+		authAccessToken(ctx, token)
+		return
+	}
 	sid, err := ctx.Cookie("session")
 	if err != nil {
 		ctx.JSON(http.StatusOK, unauthorized())
@@ -28,6 +35,13 @@ func AuthRequired(ctx *gin.Context) {
 		ctx.Abort()
 		return
 	}
+	if sessionExpired(session, time.Now()) {
+		db.Unscoped().Delete(&session)
+		clearSessionCookie(ctx)
+		ctx.JSON(http.StatusOK, unauthorized())
+		ctx.Abort()
+		return
+	}
 	if time.Now().Sub(session.LastAccessed) > time.Minute*5 ||
 		session.IP != ctx.ClientIP() ||
 		session.UserAgent != ctx.Request.UserAgent() {
@@ -36,8 +50,15 @@ func AuthRequired(ctx *gin.Context) {
 		session.IP = ctx.ClientIP()
 		db.Save(&session)
 	}
+	if session.User.Disabled {
+		db.Unscoped().Delete(&session)
+		clearSessionCookie(ctx)
+		ctx.JSON(http.StatusOK, userDisabled())
+		ctx.Abort()
+		return
+	}
 	// Renew cookie
-	ctx.SetCookie("session", session.SessionID, 86400*7, "/", "", false, true)
+	setSessionCookie(ctx, session)
 	ctx.Set("user", session.User)
 	ctx.Set("session", session)
 	if config.Cfg.Enforce2FA {
@@ -45,6 +66,14 @@ func AuthRequired(ctx *gin.Context) {
 	}
 }
 
+func AdminRequired(ctx *gin.Context) {
+	user := ctx.MustGet("user").(model.User)
+	if user.Role != model.RoleAdmin {
+		ctx.JSON(http.StatusOK, resErr(PermissionDenied, "admin required"))
+		ctx.Abort()
+	}
+}
+
 func unauthorized() Response {
 	return Response{
 		Status:  Unauthorized,
@@ -53,48 +82,56 @@ func unauthorized() Response {
 	}
 }
 
-var tfaAttempts map[string]int
-
 func initMiddleware() {
 	go func() {
 		t := time.NewTicker(time.Hour)
 		for {
 			<-t.C
-			tfaAttempts = make(map[string]int)
+			authLimiter.prune()
+			for _, c := range cooldowns {
+				c.prune()
+			}
 		}
 	}()
 }
 
 func TFARequired(ctx *gin.Context) {
-	session := ctx.MustGet("session").(model.Session)
-	if tfaAttempts[session.SessionID] >= 5 {
-		ctx.JSON(http.StatusOK, Response{
-			Status:  TFAAttemptLimited,
-			Message: "attempt too frequent",
-			Data:    nil,
-		})
-		ctx.Abort()
+	user := ctx.MustGet("user").(model.User)
+	if !has2FA(user) {
 		return
 	}
-	user := ctx.MustGet("user").(model.User)
-	if !user.Enable2FA {
+	ipKey, userKey := ipLimitKey(ctx.ClientIP()), tfaLimitKey(user.ID)
+	if d := authLimiter.locked(ipKey, userKey); d > 0 {
+		ctx.JSON(http.StatusOK, attemptLimited(TFAAttemptLimited, d))
+		ctx.Abort()
 		return
 	}
-	params := map[string]interface{}{}
-	if err := ctx.ShouldBind(&params); err != nil {
+	// The body is read again by the handler, so it has to be restored
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
 		ctx.JSON(http.StatusOK, illegalParams("failed to read 2fa token"))
 		ctx.Abort()
+		return
 	}
-	code, ok := params["2fa_code"].(string)
-	if !ok {
-		ctx.JSON(http.StatusOK, wrong2FACode())
-		ctx.Abort()
+	form := TFAForm{}
+	if len(body) != 0 {
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("failed to read 2fa token"))
+			ctx.Abort()
+			return
+		}
 	}
-	if !totp.Validate(code, user.Secret) {
-		tfaAttempts[session.SessionID]++
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	if !verifySecondFactor(user, form.Code, form.WebAuthn) {
+		authLimiter.fail(ipKey, config.Cfg.LoginLimit.IPAttempts)
+		authLimiter.fail(userKey, config.Cfg.LoginLimit.AccountAttempts)
+		audit(ctx, AuditSecondFactor, user.ID, false, ctx.Request.Method+" "+ctx.Request.URL.Path)
 		ctx.JSON(http.StatusOK, wrong2FACode())
 		ctx.Abort()
+		return
 	}
+	authLimiter.reset(userKey)
 }
 
 func enforce2FA(ctx *gin.Context) {
@@ -102,7 +139,7 @@ func enforce2FA(ctx *gin.Context) {
 		return
 	}
 	user := ctx.MustGet("user").(model.User)
-	if user.Enable2FA {
+	if has2FA(user) {
 		return
 	}
 	ctx.JSON(http.StatusOK, Response{
@@ -114,7 +151,8 @@ func enforce2FA(ctx *gin.Context) {
 }
 
 func whitelistEndpoint(method, uri string) bool {
-	return (method == "POST") && (uri == "/api/user/logout" || uri == "/api/user/login" || uri == "/api/features/2fa")
+	return (method == "POST") && (uri == "/api/user/logout" || uri == "/api/user/login" || uri == "/api/features/2fa" ||
+		uri == "/api/features/webauthn/register" || uri == "/api/features/webauthn/register/finish")
 }
 
 func wrong2FACode() Response {
@@ -125,6 +163,51 @@ func wrong2FACode() Response {
 	}
 }
 
+// CSRFProtection rejects state changing requests sent by browsers from
+// other origins. Requests authenticated by access tokens are exempt, as
+// browsers never attach those by themselves.
+func CSRFProtection(ctx *gin.Context) {
+	switch ctx.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return
+	}
+	if _, ok := bearerToken(ctx); ok {
+		return
+	}
+	switch ctx.GetHeader("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return
+	}
+	origin := ctx.GetHeader("Origin")
+	if origin == "" {
+		if referer, err := url.Parse(ctx.GetHeader("Referer")); err == nil && referer.Host != "" {
+			origin = referer.Scheme + "://" + referer.Host
+		}
+	}
+	// Non-browser clients send neither header
+	if origin == "" || trustedOrigin(ctx, origin) {
+		return
+	}
+	ctx.JSON(http.StatusOK, resErr(PermissionDenied, "cross-origin request rejected"))
+	ctx.Abort()
+}
+
+func trustedOrigin(ctx *gin.Context, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, ctx.Request.Host) {
+		return true
+	}
+	for _, v := range append([]string{config.Cfg.SiteURL}, config.Cfg.TrustedOrigins...) {
+		if t, err := url.Parse(v); err == nil && strings.EqualFold(t.Scheme, u.Scheme) && strings.EqualFold(t.Host, u.Host) {
+			return true
+		}
+	}
+	return false
+}
+
 func CustomHeaders(ctx *gin.Context) {
 	for k, v := range config.Cfg.Headers {
 		ctx.Header(k, v)
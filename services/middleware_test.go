@@ -0,0 +1,62 @@
+package services
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCSRFProtection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	siteURL, trusted := config.Cfg.SiteURL, config.Cfg.TrustedOrigins
+	config.Cfg.SiteURL = "https://anniv.example"
+	config.Cfg.TrustedOrigins = []string{"https://app.example:8443"}
+	t.Cleanup(func() { config.Cfg.SiteURL, config.Cfg.TrustedOrigins = siteURL, trusted })
+
+	ng := gin.New()
+	ng.Use(CSRFProtection)
+	ng.Any("/api/test", func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "ok")
+	})
+
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		allowed bool
+	}{
+		{"safe method", http.MethodGet, map[string]string{"Origin": "https://evil.example"}, true},
+		{"options", http.MethodOptions, map[string]string{"Origin": "https://evil.example"}, true},
+		{"no headers", http.MethodPost, nil, true},
+		{"same host", http.MethodPost, map[string]string{"Origin": "http://api.example"}, true},
+		{"same host other case", http.MethodPost, map[string]string{"Origin": "http://API.example"}, true},
+		{"site url", http.MethodPost, map[string]string{"Origin": "https://anniv.example"}, true},
+		{"site url over http", http.MethodPost, map[string]string{"Origin": "http://anniv.example"}, false},
+		{"trusted origin", http.MethodDelete, map[string]string{"Origin": "https://app.example:8443"}, true},
+		{"trusted host other port", http.MethodPost, map[string]string{"Origin": "https://app.example"}, false},
+		{"foreign origin", http.MethodPost, map[string]string{"Origin": "https://evil.example"}, false},
+		{"subdomain of site", http.MethodPatch, map[string]string{"Origin": "https://evil.anniv.example"}, false},
+		{"null origin", http.MethodPost, map[string]string{"Origin": "null"}, false},
+		{"foreign referer", http.MethodPost, map[string]string{"Referer": "https://evil.example/page"}, false},
+		{"site referer", http.MethodPost, map[string]string{"Referer": "https://anniv.example/login"}, true},
+		{"sec-fetch same origin", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "https://evil.example"}, true},
+		{"sec-fetch user initiated", http.MethodPost, map[string]string{"Sec-Fetch-Site": "none"}, true},
+		{"sec-fetch cross site", http.MethodPost, map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "https://evil.example"}, false},
+		{"sec-fetch same site", http.MethodPost, map[string]string{"Sec-Fetch-Site": "same-site", "Origin": "https://evil.example"}, false},
+		{"bearer token", http.MethodPost, map[string]string{"Authorization": "Bearer abc", "Origin": "https://evil.example"}, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://api.example/api/test", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		ng.ServeHTTP(w, req)
+		if allowed := w.Body.String() == "ok"; allowed != tt.allowed {
+			t.Errorf("%s: allowed = %v, want %v (%s)", tt.name, allowed, tt.allowed, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const oidcFlowTTL = 10 * time.Minute
+
+// The state of a flow is also kept in this cookie, so that a callback
+// is only accepted from the browser that started the flow.
+const oidcStateCookie = "oidc_state"
+
+// Identifies a login waiting for the second factor of the user.
+const oidcChallengeCookie = "oidc_2fa"
+
+var errOIDCFailed = errors.New("oidc authentication failed")
+
+func EndpointOIDC(ng *gin.Engine) {
+	g := ng.Group("/api/user/oidc")
+
+	g.GET("", func(ctx *gin.Context) {
+		res := make([]OIDCProviderInfo, 0, len(config.Cfg.OIDC))
+		for _, v := range config.Cfg.OIDC {
+			res = append(res, OIDCProviderInfo{Name: v.Name, DisplayName: v.DisplayName})
+		}
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	// Redirects the browser to the provider. After the callback it is sent
+	// back to the relative url given in redirect, with 2fa=required added
+	// if the login still has to be finished through POST /2fa. An invite
+	// code is needed to create accounts when invites are required.
+	g.GET("/:provider/login", func(ctx *gin.Context) {
+		client, err := oidcClientFor(ctx.Param("provider"))
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(NotFound, err.Error()))
+			return
+		}
+		url := client.startFlow(ctx, oidcFlow{redirect: ctx.Query("redirect"), invite: ctx.Query("invite")})
+		ctx.Redirect(http.StatusFound, url)
+	})
+
+	// Returns the url to link an identity of the provider to the current
+	// user, since the browser has to navigate there by itself.
+	g.POST("/:provider/link", AuthRequired, TFARequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		client, err := oidcClientFor(ctx.Param("provider"))
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(NotFound, err.Error()))
+			return
+		}
+		url := client.startFlow(ctx, oidcFlow{userID: user.ID, redirect: ctx.Query("redirect")})
+		ctx.JSON(http.StatusOK, resOk(url))
+	})
+
+	g.GET("/:provider/callback", func(ctx *gin.Context) {
+		client, err := oidcClientFor(ctx.Param("provider"))
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(NotFound, err.Error()))
+			return
+		}
+		state := ctx.Query("state")
+		cookie, _ := ctx.Cookie(oidcStateCookie)
+		setOIDCCookie(ctx, oidcStateCookie, "", -1)
+		if cookie == "" || subtle.ConstantTimeCompare([]byte(cookie), []byte(state)) != 1 {
+			ctx.JSON(http.StatusOK, resErr(OIDCFailed, "invalid or expired state"))
+			return
+		}
+		flow, ok := takeOIDCFlow(state, client.name)
+		if !ok {
+			ctx.JSON(http.StatusOK, resErr(OIDCFailed, "invalid or expired state"))
+			return
+		}
+		if e := ctx.Query("error"); e != "" {
+			ctx.JSON(http.StatusOK, resErr(OIDCFailed, "provider returned "+e))
+			return
+		}
+		claims, err := client.exchange(ctx, ctx.Query("code"), flow)
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(OIDCFailed, err.Error()))
+			return
+		}
+
+		if flow.userID != 0 {
+			user := model.User{}
+			if err := db.Where("id = ?", flow.userID).First(&user).Error; err != nil {
+				ctx.JSON(http.StatusOK, userNotFound())
+				return
+			}
+			if user.Disabled {
+				ctx.JSON(http.StatusOK, userDisabled())
+				return
+			}
+			identity := model.UserIdentity{
+				UserID:   flow.userID,
+				Provider: client.name,
+				Subject:  claims.Subject,
+				Email:    claims.Email,
+			}
+			if db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)}).
+				Where("provider = ? AND subject = ?", client.name, claims.Subject).
+				First(&model.UserIdentity{}).RowsAffected != 0 {
+				ctx.JSON(http.StatusOK, resErr(IdentityLinked, "identity already linked to a user"))
+				return
+			}
+			if err := db.Create(&identity).Error; err != nil {
+				ctx.JSON(http.StatusOK, writeErr(err))
+				return
+			}
+			audit(ctx, AuditIdentityLink, flow.userID, true, client.name)
+			ctx.Redirect(http.StatusFound, flow.redirect)
+			return
+		}
+
+		user, status, err := oidcUser(ctx, client, claims, flow.invite)
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(status, err.Error()))
+			return
+		}
+		if user.Disabled {
+			audit(ctx, AuditLogin, user.ID, false, "account disabled")
+			ctx.JSON(http.StatusOK, userDisabled())
+			return
+		}
+		if emailVerificationRequired() && !user.EmailVerified {
+			audit(ctx, AuditLogin, user.ID, false, "email not verified")
+			ctx.JSON(http.StatusOK, resErr(EmailNotVerified, "email not verified"))
+			return
+		}
+		// The provider only replaces the password, the second factor is
+		// still required
+		if has2FA(user) {
+			id := startOIDCChallenge(user.ID, client.name)
+			setOIDCCookie(ctx, oidcChallengeCookie, id, int(oidcFlowTTL.Seconds()))
+			ctx.Redirect(http.StatusFound, withQuery(flow.redirect, "2fa", "required"))
+			return
+		}
+		session, err := createSession(ctx, user)
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditLogin, user.ID, true, "oidc "+client.name)
+		setSessionCookie(ctx, session)
+		ctx.Redirect(http.StatusFound, flow.redirect)
+	})
+
+	// Starts a webauthn assertion for a login waiting for its second factor.
+	g.POST("/2fa/assert", func(ctx *gin.Context) {
+		challenge, ok := oidcChallengeFor(ctx)
+		if !ok || webAuthn == nil {
+			ctx.JSON(http.StatusOK, resErr(OIDCFailed, "invalid or expired login"))
+			return
+		}
+		user := model.User{}
+		if err := db.Where("id = ?", challenge.userID).First(&user).Error; err != nil {
+			ctx.JSON(http.StatusOK, userNotFound())
+			return
+		}
+		info, err := beginWebAuthnAssertion(&user, ctx.ClientIP())
+		if err != nil {
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(info))
+	})
+
+	// Finishes a login through the provider with the second factor.
+	g.POST("/2fa", func(ctx *gin.Context) {
+		form := TFAForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed 2fa form"))
+			return
+		}
+		id, _ := ctx.Cookie(oidcChallengeCookie)
+		challenge, ok := oidcChallengeFor(ctx)
+		if !ok {
+			ctx.JSON(http.StatusOK, resErr(OIDCFailed, "invalid or expired login"))
+			return
+		}
+		ipKey, userKey := ipLimitKey(ctx.ClientIP()), tfaLimitKey(challenge.userID)
+		if d := authLimiter.locked(ipKey, userKey); d > 0 {
+			ctx.JSON(http.StatusOK, attemptLimited(TFAAttemptLimited, d))
+			return
+		}
+		user := model.User{}
+		if err := db.Where("id = ?", challenge.userID).First(&user).Error; err != nil {
+			ctx.JSON(http.StatusOK, userNotFound())
+			return
+		}
+		if user.Disabled {
+			audit(ctx, AuditLogin, user.ID, false, "account disabled")
+			ctx.JSON(http.StatusOK, userDisabled())
+			return
+		}
+		if !verifySecondFactor(user, form.Code, form.WebAuthn) {
+			authLimiter.fail(ipKey, config.Cfg.LoginLimit.IPAttempts)
+			authLimiter.fail(userKey, config.Cfg.LoginLimit.AccountAttempts)
+			audit(ctx, AuditLogin, user.ID, false, "wrong second factor")
+			ctx.JSON(http.StatusOK, wrong2FACode())
+			return
+		}
+		authLimiter.reset(userKey)
+		if _, ok := takeOIDCChallenge(id); !ok {
+			ctx.JSON(http.StatusOK, resErr(OIDCFailed, "invalid or expired login"))
+			return
+		}
+		setOIDCCookie(ctx, oidcChallengeCookie, "", -1)
+		session, err := createSession(ctx, user)
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditLogin, user.ID, true, "oidc "+challenge.provider)
+		setSessionCookie(ctx, session)
+		ctx.JSON(http.StatusOK, resOk(userInfo(user)))
+	})
+
+	identities := ng.Group("/api/user/identities", AuthRequired)
+
+	identities.GET("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		var list []model.UserIdentity
+		if err := db.Where("user_id = ?", user.ID).Order("created_at").Find(&list).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		res := make([]UserIdentityInfo, 0, len(list))
+		for _, v := range list {
+			res = append(res, userIdentityInfo(v))
+		}
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	identities.DELETE("", TFARequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := DeleteForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed delete form"))
+			return
+		}
+		var count int64
+		if err := db.Model(&model.UserIdentity{}).Where("user_id = ?", user.ID).
+			Count(&count).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		passwordUsable := user.Password != "" && !config.Cfg.DisablePasswordLogin
+		if count <= 1 && !passwordUsable && (webAuthn == nil || !hasWebAuthn(user.ID)) {
+			ctx.JSON(http.StatusOK, resErr(PermissionDenied, "cannot unlink the last way to sign in"))
+			return
+		}
+		res := db.Unscoped().Where("id = ? AND user_id = ?", form.ID, user.ID).Delete(&model.UserIdentity{})
+		if res.Error != nil {
+			ctx.JSON(http.StatusOK, writeErr(res.Error))
+			return
+		}
+		if res.RowsAffected == 0 {
+			ctx.JSON(http.StatusOK, resErr(NotFound, "identity not found"))
+			return
+		}
+		audit(ctx, AuditIdentityUnlink, user.ID, true, "identity "+form.ID)
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+}
+
+type oidcClaims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nickname      string `json:"preferred_username"`
+}
+
+// oidcUser finds the user linked to the identity in claims, creating
+// one if the provider allows it.
+func oidcUser(ctx *gin.Context, client *oidcClient, claims oidcClaims, inviteCode string) (model.User, int, error) {
+	silent := db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})
+	identity := model.UserIdentity{}
+	if err := silent.Where("provider = ? AND subject = ?", client.name, claims.Subject).
+		First(&identity).Error; err == nil {
+		user := model.User{}
+		if err := db.Where("id = ?", identity.UserID).First(&user).Error; err != nil {
+			return user, ReadErr, err
+		}
+		return user, StatusOK, nil
+	}
+	if !client.cfg.AutoRegister {
+		return model.User{}, UserNotExist, errors.New("no user linked to this identity")
+	}
+	var invite *model.Invite
+	if config.Cfg.RequireInvite {
+		var ok bool
+		if invite, ok = findInvite(inviteCode); !ok {
+			return model.User{}, InvalidInviteCode, errors.New("invalid invite code")
+		}
+	}
+	if claims.Email == "" || !emailReg.MatchString(claims.Email) {
+		return model.User{}, EmailUnavailable, errors.New("provider did not return a valid email")
+	}
+	// Linking an existing account by email would let anyone controlling
+	// the provider account take it over, so it has to be done explicitly.
+	if silent.Where("email = ?", claims.Email).First(&model.User{}).RowsAffected != 0 {
+		return model.User{}, EmailUnavailable, errors.New("email already taken, sign in and link the identity instead")
+	}
+
+	nickname := claims.Nickname
+	if nickname == "" {
+		nickname = claims.Name
+	}
+	for len(nickname) > NicknameMaxLen {
+		r := []rune(nickname)
+		nickname = string(r[:len(r)-1])
+	}
+	nickname = strings.TrimSpace(nickname)
+	user := model.User{
+		Email:         claims.Email,
+		Nickname:      nickname,
+		EmailVerified: claims.EmailVerified,
+	}
+	tokens, err := signUserTokens(claims.Email)
+	if err != nil {
+		return user, InternalError, errors.New("failed to sign default tokens: " + err.Error())
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if invite != nil {
+			if err := consumeInvite(tx, invite, &user); err != nil {
+				return err
+			}
+		}
+		if err := createUser(tx, &user, tokens); err != nil {
+			return err
+		}
+		return tx.Create(&model.UserIdentity{
+			UserID:   user.ID,
+			Provider: client.name,
+			Subject:  claims.Subject,
+			Email:    claims.Email,
+		}).Error
+	})
+	if err == errInviteUsedUp {
+		return user, InvalidInviteCode, errors.New("invalid invite code")
+	} else if err != nil {
+		return user, WriteErr, err
+	}
+	audit(ctx, AuditRegister, user.ID, true, "oidc "+client.name)
+	if mailEnabled() && !user.EmailVerified {
+		sendVerificationMail(user)
+	}
+	return user, StatusOK, nil
+}
+
+type oidcClient struct {
+	name     string
+	cfg      config.OIDCProvider
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+var oidcClients = struct {
+	sync.Mutex
+	m map[string]*oidcClient
+}{m: make(map[string]*oidcClient)}
+
+// oidcClientFor returns the client of a configured provider. Discovery
+// happens on first use, so that an unreachable provider doesn't prevent
+// startup. It runs without holding the lock, so a slow provider only
+// delays its own requests.
+func oidcClientFor(name string) (*oidcClient, error) {
+	oidcClients.Lock()
+	c, ok := oidcClients.m[name]
+	oidcClients.Unlock()
+	if ok {
+		return c, nil
+	}
+	for _, v := range config.Cfg.OIDC {
+		if v.Name != name {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		provider, err := oidc.NewProvider(ctx, v.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		scopes := v.Scopes
+		if len(scopes) == 0 {
+			scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+		}
+		c := &oidcClient{
+			name: name,
+			cfg:  v,
+			oauth: oauth2.Config{
+				ClientID:     v.ClientID,
+				ClientSecret: v.ClientSecret,
+				Endpoint:     provider.Endpoint(),
+				RedirectURL:  strings.TrimSuffix(config.Cfg.SiteURL, "/") + "/api/user/oidc/" + name + "/callback",
+				Scopes:       scopes,
+			},
+			verifier: provider.Verifier(&oidc.Config{ClientID: v.ClientID}),
+		}
+		oidcClients.Lock()
+		defer oidcClients.Unlock()
+		// Keep the client of a concurrent discovery that finished first
+		if existing, ok := oidcClients.m[name]; ok {
+			return existing, nil
+		}
+		oidcClients.m[name] = c
+		return c, nil
+	}
+	return nil, errors.New("unknown provider")
+}
+
+// oidcFlow is the state kept between redirecting to the provider and
+// its callback.
+type oidcFlow struct {
+	provider string
+	// Set when linking an identity to an existing user
+	userID   uint
+	redirect string
+	// Invite code used if a new account is created
+	invite   string
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+var oidcFlows = struct {
+	sync.Mutex
+	m map[string]oidcFlow
+}{m: make(map[string]oidcFlow)}
+
+// startFlow stores a new flow, binds it to the browser through a
+// cookie and returns the authorization url.
+func (c *oidcClient) startFlow(ctx *gin.Context, flow oidcFlow) string {
+	if !strings.HasPrefix(flow.redirect, "/") || strings.HasPrefix(flow.redirect, "//") ||
+		strings.HasPrefix(flow.redirect, "/\\") {
+		flow.redirect = "/"
+	}
+	flow.provider = c.name
+	flow.nonce = uuid.NewString()
+	flow.verifier = oauth2.GenerateVerifier()
+
+	oidcFlows.Lock()
+	defer oidcFlows.Unlock()
+	now := time.Now()
+	for k, v := range oidcFlows.m {
+		if now.After(v.expires) {
+			delete(oidcFlows.m, k)
+		}
+	}
+	state := uuid.NewString()
+	flow.expires = now.Add(oidcFlowTTL)
+	oidcFlows.m[state] = flow
+	setOIDCCookie(ctx, oidcStateCookie, state, int(oidcFlowTTL.Seconds()))
+	return c.oauth.AuthCodeURL(state, oidc.Nonce(flow.nonce), oauth2.S256ChallengeOption(flow.verifier))
+}
+
+// setOIDCCookie sets one of the cookies of a flow, which have to be lax
+// since the callback is a cross site navigation from the provider.
+func setOIDCCookie(ctx *gin.Context, name, value string, maxAge int) {
+	cfg := config.Cfg.Cookie
+	ctx.SetSameSite(http.SameSiteLaxMode)
+	ctx.SetCookie(name, value, maxAge, "/api/user/oidc", cfg.Domain, cfg.Secure, true)
+}
+
+// withQuery adds a query parameter to a relative url.
+func withQuery(redirect, key, value string) string {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return redirect
+	}
+	q := u.Query()
+	q.Set(key, value)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// oidcChallenge is a login through a provider waiting for the second
+// factor of the user.
+type oidcChallenge struct {
+	userID   uint
+	provider string
+	expires  time.Time
+}
+
+var oidcChallenges = struct {
+	sync.Mutex
+	m map[string]oidcChallenge
+}{m: make(map[string]oidcChallenge)}
+
+func startOIDCChallenge(userID uint, provider string) string {
+	oidcChallenges.Lock()
+	defer oidcChallenges.Unlock()
+	now := time.Now()
+	for k, v := range oidcChallenges.m {
+		if now.After(v.expires) {
+			delete(oidcChallenges.m, k)
+		}
+	}
+	id := uuid.NewString()
+	oidcChallenges.m[id] = oidcChallenge{userID: userID, provider: provider, expires: now.Add(oidcFlowTTL)}
+	return id
+}
+
+// oidcChallengeFor returns the pending challenge of the browser without
+// removing it, so that a mistyped code can be retried.
+func oidcChallengeFor(ctx *gin.Context) (oidcChallenge, bool) {
+	id, _ := ctx.Cookie(oidcChallengeCookie)
+	oidcChallenges.Lock()
+	defer oidcChallenges.Unlock()
+	c, ok := oidcChallenges.m[id]
+	return c, ok && time.Now().Before(c.expires)
+}
+
+func takeOIDCChallenge(id string) (oidcChallenge, bool) {
+	oidcChallenges.Lock()
+	defer oidcChallenges.Unlock()
+	c, ok := oidcChallenges.m[id]
+	if !ok {
+		return c, false
+	}
+	delete(oidcChallenges.m, id)
+	return c, time.Now().Before(c.expires)
+}
+
+func takeOIDCFlow(state, provider string) (oidcFlow, bool) {
+	oidcFlows.Lock()
+	defer oidcFlows.Unlock()
+	flow, ok := oidcFlows.m[state]
+	if !ok {
+		return flow, false
+	}
+	delete(oidcFlows.m, state)
+	return flow, flow.provider == provider && time.Now().Before(flow.expires)
+}
+
+// exchange redeems the authorization code and verifies the id token.
+func (c *oidcClient) exchange(ctx context.Context, code string, flow oidcFlow) (oidcClaims, error) {
+	claims := oidcClaims{}
+	token, err := c.oauth.Exchange(ctx, code, oauth2.VerifierOption(flow.verifier))
+	if err != nil {
+		return claims, errOIDCFailed
+	}
+	raw, ok := token.Extra("id_token").(string)
+	if !ok {
+		return claims, errors.New("no id token returned")
+	}
+	idToken, err := c.verifier.Verify(ctx, raw)
+	if err != nil || idToken.Nonce != flow.nonce {
+		return claims, errOIDCFailed
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return claims, err
+	}
+	if claims.Subject == "" {
+		return claims, errOIDCFailed
+	}
+	return claims, nil
+}
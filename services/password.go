@@ -0,0 +1,191 @@
+package services
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+const passwordMaxLen = 256
+
+// bcrypt ignores everything past 72 bytes
+const bcryptPasswordMaxLen = 72
+
+var sha1Reg = regexp.MustCompile("^[0-9A-Fa-f]{40}$")
+
+// breachedPasswords holds upper case sha1 hashes of known breached passwords.
+var breachedPasswords map[string]bool
+
+var errMalformedHash = errors.New("malformed password hash")
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// initPasswordPolicy loads the breached password list, accepting both
+// plain passwords and sha1 hashes in the format of haveibeenpwned.
+func initPasswordPolicy() error {
+	breachedPasswords = make(map[string]bool)
+	path := config.Cfg.Password.BreachedList
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if hash, _, _ := strings.Cut(line, ":"); sha1Reg.MatchString(hash) {
+			breachedPasswords[strings.ToUpper(hash)] = true
+			continue
+		}
+		breachedPasswords[sha1Hex(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	log.Printf("Loaded %d breached passwords.\n", len(breachedPasswords))
+	return nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// checkPasswordPolicy returns a message describing why a password is
+// rejected, or an empty string if it is acceptable.
+func checkPasswordPolicy(password string) string {
+	if utf8.RuneCountInString(password) < config.Cfg.Password.MinLength {
+		return fmt.Sprintf("password must be at least %d characters", config.Cfg.Password.MinLength)
+	}
+	maxLen := passwordMaxLen
+	if config.Cfg.Password.Algorithm == HashBcrypt {
+		maxLen = bcryptPasswordMaxLen
+	}
+	if len(password) > maxLen {
+		return fmt.Sprintf("password must be at most %d bytes", maxLen)
+	}
+	if breachedPasswords[sha1Hex(password)] {
+		return "password appears in a known data breach"
+	}
+	return ""
+}
+
+func weakPassword(msg string) Response {
+	return resErr(WeakPassword, msg)
+}
+
+// hashPassword hashes a password with the configured algorithm.
+func hashPassword(password string) (string, error) {
+	if config.Cfg.Password.Algorithm == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), config.Cfg.Password.BcryptCost)
+		return string(hash), err
+	}
+	c := config.Cfg.Password.Argon2
+	salt := make([]byte, c.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, c.Iterations, c.Memory, c.Parallelism, c.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, c.Memory, c.Iterations,
+		c.Parallelism, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// verifyPassword checks a password against a bcrypt or argon2id hash.
+func verifyPassword(hash, password string) bool {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	p, err := parseArgon2Hash(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), p.salt, p.iterations, p.memory, p.parallelism, uint32(len(p.key)))
+	return subtle.ConstantTimeCompare(key, p.key) == 1
+}
+
+// passwordNeedsRehash reports whether a hash was made with another
+// algorithm or other parameters than currently configured.
+func passwordNeedsRehash(hash string) bool {
+	if config.Cfg.Password.Algorithm == HashBcrypt {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != config.Cfg.Password.BcryptCost
+	}
+	p, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+	c := config.Cfg.Password.Argon2
+	return p.memory != c.Memory || p.iterations != c.Iterations || p.parallelism != c.Parallelism ||
+		uint32(len(p.salt)) != c.SaltLength || uint32(len(p.key)) != c.KeyLength
+}
+
+// rehashPassword upgrades the stored hash of a user after a successful
+// login with the plain password.
+func rehashPassword(user *model.User, password string) {
+	if !passwordNeedsRehash(user.Password) {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %d: %v\n", user.ID, err)
+		return
+	}
+	if err := db.Model(user).Update("password", hash).Error; err != nil {
+		log.Printf("Failed to rehash password of user %d: %v\n", user.ID, err)
+	}
+}
+
+func parseArgon2Hash(hash string) (*argon2Params, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, errMalformedHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, errMalformedHash
+	}
+	p := argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.memory, &p.iterations, &p.parallelism); err != nil {
+		return nil, errMalformedHash
+	}
+	var err error
+	if p.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, errMalformedHash
+	}
+	if p.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(p.key) == 0 {
+		return nil, errMalformedHash
+	}
+	return &p, nil
+}
@@ -113,6 +113,7 @@ func EndpointPlaylist(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		reindexPlaylist(playlist.ID)
 
 		info, err := queryPlaylist(playlist)
 		if err != nil {
@@ -155,6 +156,7 @@ func EndpointPlaylist(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		unindexPlaylist(playlist.ID)
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 
@@ -378,6 +380,7 @@ func EndpointPlaylist(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, resErr(InvalidPatchCommand, "invalid patch command"))
 			return
 		}
+		reindexPlaylist(playlist.ID)
 		res, err := queryPlaylist(playlist)
 		if err != nil {
 			ctx.JSON(http.StatusOK, readErr(err))
@@ -0,0 +1,162 @@
+package services
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+	"github.com/blevesearch/bleve/v2/search/query"
+)
+
+type playlistDoc struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Notes       []string `json:"notes"`
+	IsPublic    bool     `json:"is_public"`
+	Owner       string   `json:"owner"`
+}
+
+var playlistIdx bleve.Index
+
+func initPlaylistIndex() error {
+	log.Println("Building playlist search index...")
+	start := time.Now()
+
+	text := bleve.NewTextFieldMapping()
+	text.Analyzer = standard.Name
+	kw := bleve.NewTextFieldMapping()
+	kw.Analyzer = keyword.Name
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("name", text)
+	doc.AddFieldMappingsAt("description", text)
+	doc.AddFieldMappingsAt("notes", text)
+	doc.AddFieldMappingsAt("is_public", bleve.NewBooleanFieldMapping())
+	doc.AddFieldMappingsAt("owner", kw)
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+
+	var err error
+	playlistIdx, err = bleve.New("", m)
+	if err != nil {
+		return err
+	}
+
+	var playlists []model.Playlist
+	if err := db.Find(&playlists).Error; err != nil {
+		return err
+	}
+	var songs []model.PlaylistSong
+	if err := db.Select("playlist_id", "description").
+		Where("description <> ''").Find(&songs).Error; err != nil {
+		return err
+	}
+	notes := make(map[uint][]string)
+	for _, v := range songs {
+		notes[v.PlaylistID] = append(notes[v.PlaylistID], v.Description)
+	}
+
+	batch := playlistIdx.NewBatch()
+	for _, v := range playlists {
+		if err := batch.Index(strconv.Itoa(int(v.ID)), newPlaylistDoc(v, notes[v.ID])); err != nil {
+			return err
+		}
+	}
+	if err := playlistIdx.Batch(batch); err != nil {
+		return err
+	}
+
+	log.Printf("Done, took %d ms.\n", time.Now().Sub(start).Milliseconds())
+	return nil
+}
+
+func newPlaylistDoc(p model.Playlist, notes []string) playlistDoc {
+	return playlistDoc{
+		Name:        p.Name,
+		Description: p.Description,
+		Notes:       notes,
+		IsPublic:    p.IsPublic,
+		Owner:       strconv.Itoa(int(p.UserID)),
+	}
+}
+
+// reindexPlaylist reloads a playlist from the database and updates its
+// search document. Failures are only logged, since the playlist itself
+// has already been written.
+func reindexPlaylist(id uint) {
+	var playlist model.Playlist
+	if err := db.Where("id = ?", id).First(&playlist).Error; err != nil {
+		log.Printf("Failed to reindex playlist %d: %v\n", id, err)
+		return
+	}
+	var notes []string
+	if err := db.Model(&model.PlaylistSong{}).
+		Where("playlist_id = ? AND description <> ''", id).
+		Pluck("description", &notes).Error; err != nil {
+		log.Printf("Failed to reindex playlist %d: %v\n", id, err)
+		return
+	}
+	if err := playlistIdx.Index(strconv.Itoa(int(id)), newPlaylistDoc(playlist, notes)); err != nil {
+		log.Printf("Failed to reindex playlist %d: %v\n", id, err)
+	}
+}
+
+func unindexPlaylist(id uint) {
+	if err := playlistIdx.Delete(strconv.Itoa(int(id))); err != nil {
+		log.Printf("Failed to unindex playlist %d: %v\n", id, err)
+	}
+}
+
+// searchPlaylists returns the ids of public playlists and playlists
+// owned by user matching keyword, ordered by relevance. An empty
+// keyword matches every visible playlist.
+func searchPlaylists(user model.User, keyword string, limit, offset int) ([]uint, uint64, error) {
+	fields := []struct {
+		name  string
+		boost float64
+	}{
+		{"name", 3},
+		{"description", 1.5},
+		{"notes", 1},
+	}
+	var match query.Query = bleve.NewMatchAllQuery()
+	if strings.TrimSpace(keyword) != "" {
+		matches := make([]query.Query, 0, len(fields))
+		for _, f := range fields {
+			q := bleve.NewMatchQuery(keyword)
+			q.SetField(f.name)
+			q.SetBoost(f.boost)
+			matches = append(matches, q)
+		}
+		match = bleve.NewDisjunctionQuery(matches...)
+	}
+
+	isPublic := bleve.NewBoolFieldQuery(true)
+	isPublic.SetField("is_public")
+	owned := bleve.NewTermQuery(strconv.Itoa(int(user.ID)))
+	owned.SetField("owner")
+
+	visible := bleve.NewDisjunctionQuery(isPublic, owned)
+	visible.SetBoost(0)
+	search := bleve.NewSearchRequestOptions(
+		bleve.NewConjunctionQuery(match, visible),
+		limit, offset, false,
+	)
+	res, err := playlistIdx.Search(search)
+	if err != nil {
+		return nil, 0, err
+	}
+	ids := make([]uint, 0, len(res.Hits))
+	for _, v := range res.Hits {
+		id, err := strconv.Atoi(v.ID)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, res.Total, nil
+}
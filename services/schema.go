@@ -1,10 +1,13 @@
 package services
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/mssola/useragent"
 )
 
 type Response struct {
@@ -54,20 +57,26 @@ func resErr(status int, msg string) Response {
 }
 
 type UserInfo struct {
-	UserID    string `json:"user_id"`
-	Email     string `json:"email"`
-	Nickname  string `json:"nickname"`
-	Avatar    string `json:"avatar"`
-	Enable2FA bool   `json:"2fa_enabled"`
+	UserID        string `json:"user_id"`
+	Email         string `json:"email"`
+	Nickname      string `json:"nickname"`
+	Avatar        string `json:"avatar"`
+	Enable2FA     bool   `json:"2fa_enabled"`
+	Discoverable  bool   `json:"discoverable"`
+	Role          string `json:"role"`
+	EmailVerified bool   `json:"email_verified"`
 }
 
 func userInfo(u model.User) UserInfo {
 	return UserInfo{
-		UserID:    strconv.Itoa(int(u.ID)),
-		Email:     u.Email,
-		Nickname:  u.Nickname,
-		Avatar:    u.Avatar,
-		Enable2FA: u.Enable2FA,
+		UserID:        strconv.Itoa(int(u.ID)),
+		Email:         u.Email,
+		Nickname:      u.Nickname,
+		Avatar:        localAvatar(u.Avatar),
+		Enable2FA:     u.Enable2FA,
+		Discoverable:  u.Discoverable,
+		Role:          u.Role,
+		EmailVerified: u.EmailVerified,
 	}
 }
 
@@ -81,10 +90,15 @@ func userIntro(u model.User) UserIntro {
 	return UserIntro{
 		UserID:   strconv.Itoa(int(u.ID)),
 		Nickname: u.Nickname,
-		Avatar:   u.Avatar,
+		Avatar:   localAvatar(u.Avatar),
 	}
 }
 
+type UserSearchEntry struct {
+	UserIntro
+	PublicPlaylists int64 `json:"public_playlists"`
+}
+
 type RegisterForm struct {
 	Password   string `json:"password"`
 	Email      string `json:"email"`
@@ -96,9 +110,10 @@ type RegisterForm struct {
 }
 
 type LoginForm struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Code     string `json:"2fa_code"`
+	Email    string                 `json:"email"`
+	Password string                 `json:"password"`
+	Code     string                 `json:"2fa_code"`
+	WebAuthn *WebAuthnAssertionForm `json:"webauthn"`
 }
 
 type ChangePasswordForm struct {
@@ -106,15 +121,328 @@ type ChangePasswordForm struct {
 	NewPassword string `json:"new_password"`
 }
 
+type EmailForm struct {
+	Email string `json:"email"`
+}
+
+type ChangeEmailForm struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type TokenForm struct {
+	Token string `json:"token"`
+}
+
+type ResetPasswordForm struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
 type UserIntroForm struct {
-	Nickname string `json:"nickname"`
-	Avatar   string `json:"avatar"`
+	Nickname     string `json:"nickname"`
+	Avatar       string `json:"avatar"`
+	Discoverable *bool  `json:"discoverable"`
+}
+
+type AdminUserInfo struct {
+	UserInfo
+	Disabled  bool  `json:"disabled"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+func adminUserInfo(u model.User) AdminUserInfo {
+	return AdminUserInfo{
+		UserInfo:  userInfo(u),
+		Disabled:  u.Disabled,
+		CreatedAt: u.CreatedAt.Unix(),
+	}
+}
+
+type AdminUserPatchForm struct {
+	UserID   string  `json:"user_id"`
+	Disabled *bool   `json:"disabled"`
+	Role     *string `json:"role"`
+}
+
+type AdminPasswordForm struct {
+	UserID      string `json:"user_id"`
+	NewPassword string `json:"new_password"`
+}
+
+type AdminUserForm struct {
+	UserID string `json:"user_id"`
+}
+
+const (
+	LyricsAnonymize = "anonymize"
+	LyricsReassign  = "reassign"
+)
+
+type RevokeForm struct {
+	// What happens to contributed lyrics, anonymize by default
+	Lyrics     string `json:"lyrics"`
+	ReassignTo string `json:"reassign_to"`
+}
+
+type AdminDeleteUserForm struct {
+	UserID string `json:"user_id"`
+	RevokeForm
+}
+
+type TokenRenewForm struct {
+	// Re-sign every controlled token, even those that still look valid
+	Force bool `json:"force"`
+}
+
+type AdminTokenRenewForm struct {
+	// Renews the tokens of every user if empty
+	UserID string `json:"user_id"`
+	TokenRenewForm
+}
+
+type TokenRenewalResult struct {
+	Renewed int `json:"renewed"`
+	Failed  int `json:"failed"`
+}
+
+type InviteInfo struct {
+	Code      string `json:"code"`
+	MaxUses   int    `json:"max_uses"`
+	Uses      int    `json:"uses"`
+	ExpiresAt *int64 `json:"expires_at"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func inviteInfo(i model.Invite) InviteInfo {
+	res := InviteInfo{
+		Code:      i.Code,
+		MaxUses:   i.MaxUses,
+		Uses:      i.Uses,
+		CreatedAt: i.CreatedAt.Unix(),
+	}
+	if i.ExpiresAt != nil {
+		expires := i.ExpiresAt.Unix()
+		res.ExpiresAt = &expires
+	}
+	return res
+}
+
+type CreateInviteForm struct {
+	MaxUses int `json:"max_uses"`
+	// Lifetime of the invite in seconds, 0 for never expiring
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type InviteTreeNode struct {
+	UserIntro
+	JoinedAt int64            `json:"joined_at"`
+	Invited  []InviteTreeNode `json:"invited"`
+}
+
+type SessionInfo struct {
+	ID           string `json:"id"`
+	Device       string `json:"device"`
+	Browser      string `json:"browser"`
+	OS           string `json:"os"`
+	Mobile       bool   `json:"mobile"`
+	IP           string `json:"ip"`
+	LastAccessed int64  `json:"last_accessed"`
+	CreatedAt    int64  `json:"created_at"`
+	Current      bool   `json:"current"`
+}
+
+func sessionInfo(s model.Session, current bool) SessionInfo {
+	ua := useragent.New(s.UserAgent)
+	browser, version := ua.Browser()
+	if version != "" {
+		browser += " " + version
+	}
+	info := SessionInfo{
+		ID:           strconv.Itoa(int(s.ID)),
+		Browser:      browser,
+		OS:           ua.OS(),
+		Mobile:       ua.Mobile(),
+		IP:           s.IP,
+		LastAccessed: s.LastAccessed.Unix(),
+		CreatedAt:    s.CreatedAt.Unix(),
+		Current:      current,
+	}
+	switch {
+	case s.UserAgent == "":
+		info.Device = "Unknown device"
+	case ua.Bot():
+		info.Device = browser
+	case ua.OS() != "" && browser != "":
+		info.Device = browser + " on " + ua.OS()
+	case browser != "":
+		info.Device = browser
+	default:
+		info.Device = s.UserAgent
+	}
+	return info
 }
 
 type DeleteForm struct {
 	ID string `json:"id"`
 }
 
+type TFAForm struct {
+	Code     string                 `json:"2fa_code" form:"2fa_code"`
+	WebAuthn *WebAuthnAssertionForm `json:"webauthn" form:"-"`
+}
+
+type WebAuthnCeremonyInfo struct {
+	CeremonyID string      `json:"ceremony_id"`
+	Options    interface{} `json:"options"`
+}
+
+type WebAuthnBeginForm struct {
+	Email string `json:"email"`
+}
+
+type WebAuthnAssertionForm struct {
+	CeremonyID string          `json:"ceremony_id"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+type WebAuthnRegisterForm struct {
+	CeremonyID string          `json:"ceremony_id"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+type RenameWebAuthnForm struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnCredentialInfo struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	BackupEligible bool   `json:"backup_eligible"`
+	CreatedAt      int64  `json:"created_at"`
+	LastUsed       *int64 `json:"last_used"`
+}
+
+type WebAuthnRegisterResult struct {
+	WebAuthnCredentialInfo
+	// Only present if the passkey is the first second factor of the user
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+func webAuthnCredentialInfo(c model.WebAuthnCredential) WebAuthnCredentialInfo {
+	info := WebAuthnCredentialInfo{
+		ID:             strconv.Itoa(int(c.ID)),
+		Name:           c.Name,
+		BackupEligible: c.BackupEligible,
+		CreatedAt:      c.CreatedAt.Unix(),
+	}
+	if c.LastUsed != nil {
+		t := c.LastUsed.Unix()
+		info.LastUsed = &t
+	}
+	return info
+}
+
+type OIDCProviderInfo struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+type UserIdentityInfo struct {
+	ID       string `json:"id"`
+	Provider string `json:"provider"`
+	Email    string `json:"email"`
+	LinkedAt int64  `json:"linked_at"`
+}
+
+func userIdentityInfo(i model.UserIdentity) UserIdentityInfo {
+	return UserIdentityInfo{
+		ID:       strconv.Itoa(int(i.ID)),
+		Provider: i.Provider,
+		Email:    i.Email,
+		LinkedAt: i.CreatedAt.Unix(),
+	}
+}
+
+type AccessTokenInfo struct {
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	CreatedAt int64    `json:"created_at"`
+	ExpiresAt *int64   `json:"expires_at"`
+	LastUsed  *int64   `json:"last_used"`
+	LastIP    string   `json:"last_ip"`
+	// Only present right after creation
+	Token string `json:"token,omitempty"`
+}
+
+func accessTokenInfo(t model.AccessToken) AccessTokenInfo {
+	info := AccessTokenInfo{
+		ID:        strconv.Itoa(int(t.ID)),
+		Name:      t.Name,
+		Scopes:    strings.Split(t.Scopes, ","),
+		CreatedAt: t.CreatedAt.Unix(),
+		LastIP:    t.LastIP,
+	}
+	if t.ExpiresAt != nil {
+		v := t.ExpiresAt.Unix()
+		info.ExpiresAt = &v
+	}
+	if t.LastUsed != nil {
+		v := t.LastUsed.Unix()
+		info.LastUsed = &v
+	}
+	return info
+}
+
+type AuditEventInfo struct {
+	ID        string  `json:"id"`
+	Time      int64   `json:"time"`
+	UserID    *string `json:"user_id"`
+	ActorID   *string `json:"actor_id"`
+	Action    string  `json:"action"`
+	Success   bool    `json:"success"`
+	IP        string  `json:"ip"`
+	UserAgent string  `json:"user_agent"`
+	Detail    string  `json:"detail"`
+}
+
+func auditEventInfo(e model.AuditEvent) AuditEventInfo {
+	res := AuditEventInfo{
+		ID:        strconv.Itoa(int(e.ID)),
+		Time:      e.CreatedAt.Unix(),
+		Action:    e.Action,
+		Success:   e.Success,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Detail:    e.Detail,
+	}
+	if e.UserID != nil {
+		id := strconv.Itoa(int(*e.UserID))
+		res.UserID = &id
+	}
+	if e.ActorID != nil {
+		id := strconv.Itoa(int(*e.ActorID))
+		res.ActorID = &id
+	}
+	return res
+}
+
+type CreateAccessTokenForm struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Lifetime in seconds, 0 for tokens that never expire
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+type RecoveryCodesInfo struct {
+	// Only present right after the codes have been generated
+	Codes     []string `json:"codes,omitempty"`
+	Remaining int      `json:"remaining"`
+}
+
 type Enable2FAForm struct {
 	Secret string `json:"2fa_secret"`
 	Code   string `json:"2fa_code"`
@@ -10,9 +10,15 @@ import (
 )
 
 type SearchResult struct {
-	Albums    []meta.AlbumDetails       `json:"albums,omitempty"`
-	Tracks    []meta.TrackInfoWithAlbum `json:"tracks,omitempty"`
-	Playlists []PlaylistInfo            `json:"playlists,omitempty"`
+	Albums        []meta.AlbumDetails       `json:"albums,omitempty"`
+	Tracks        []meta.TrackInfoWithAlbum `json:"tracks,omitempty"`
+	AlbumFacets   map[string][]meta.Facet   `json:"album_facets,omitempty"`
+	TrackFacets   map[string][]meta.Facet   `json:"track_facets,omitempty"`
+	Playlists     []PlaylistInfo            `json:"playlists,omitempty"`
+	PlaylistTotal uint64                    `json:"playlist_total,omitempty"`
+	Tags          []meta.Tag                `json:"tags,omitempty"`
+	Lyrics        []LyricMatch              `json:"lyrics,omitempty"`
+	Users         []UserSearchEntry         `json:"users,omitempty"`
 }
 
 func EndpointSearch(ng *gin.Engine) {
@@ -22,28 +28,145 @@ func EndpointSearch(ng *gin.Engine) {
 		user := ctx.MustGet("user").(model.User)
 		res := SearchResult{}
 		keyword := ctx.Query("keyword")
+		opts := meta.SearchOptions{Filters: make(map[string][]string)}
+		_, opts.Facets = ctx.GetQuery("facets")
+		for _, name := range []string{"year", "type", "artist", "tag"} {
+			if values := ctx.QueryArray("filter_" + name); len(values) != 0 {
+				opts.Filters[name] = values
+			}
+		}
 		if _, f := ctx.GetQuery("search_albums"); f {
-			res.Albums = meta.SearchAlbums(keyword)
+			albums, facets, err := meta.SearchAlbums(keyword, opts)
+			if err != nil {
+				ctx.JSON(http.StatusOK, illegalParams("invalid query: "+err.Error()))
+				return
+			}
+			res.Albums = albums
+			res.AlbumFacets = facets
 		}
 		if _, f := ctx.GetQuery("search_tracks"); f {
-			res.Tracks = meta.SearchTracks(keyword)
+			tracks, facets, err := meta.SearchTracks(keyword, opts)
+			if err != nil {
+				ctx.JSON(http.StatusOK, illegalParams("invalid query: "+err.Error()))
+				return
+			}
+			res.Tracks = tracks
+			res.TrackFacets = facets
+		}
+		if _, f := ctx.GetQuery("search_tags"); f {
+			tags, err := meta.SearchTags(keyword)
+			if err != nil {
+				ctx.JSON(http.StatusOK, illegalParams("invalid query: "+err.Error()))
+				return
+			}
+			res.Tags = tags
+		}
+		if _, f := ctx.GetQuery("search_lyrics"); f {
+			limit, offset, ok := pagination(ctx)
+			if !ok {
+				return
+			}
+			lyrics, err := searchLyrics(keyword, limit, offset)
+			if err != nil {
+				ctx.JSON(http.StatusOK, readErr(err))
+				return
+			}
+			res.Lyrics = lyrics
 		}
 		if _, f := ctx.GetQuery("search_playlists"); f {
-			var playlists []model.Playlist
-			err := db.
-				Where("LOWER(name) LIKE '%' || ? || '%'", strings.ToLower(keyword)).
-				Where("is_public OR user_id=?", user.ID).
-				Find(&playlists).
-				Error
+			limit, offset, ok := pagination(ctx)
+			if !ok {
+				return
+			}
+			ids, total, err := searchPlaylists(user, keyword, limit, offset)
 			if err != nil {
 				ctx.JSON(http.StatusOK, readErr(err))
 				return
 			}
-			res.Playlists = make([]PlaylistInfo, 0, len(playlists))
+			var playlists []model.Playlist
+			if err := db.Where("id IN ?", ids).Find(&playlists).Error; err != nil {
+				ctx.JSON(http.StatusOK, readErr(err))
+				return
+			}
+			byId := make(map[uint]model.Playlist, len(playlists))
 			for _, v := range playlists {
-				res.Playlists = append(res.Playlists, playlistInfo(v))
+				byId[v.ID] = v
+			}
+			res.Playlists = make([]PlaylistInfo, 0, len(ids))
+			for _, id := range ids {
+				if v, ok := byId[id]; ok {
+					res.Playlists = append(res.Playlists, playlistInfo(v))
+				}
 			}
+			res.PlaylistTotal = total
+		}
+		if _, f := ctx.GetQuery("search_users"); f {
+			users, err := searchUsers(keyword)
+			if err != nil {
+				ctx.JSON(http.StatusOK, readErr(err))
+				return
+			}
+			res.Users = users
 		}
 		ctx.JSON(http.StatusOK, resOk(res))
 	})
 }
+
+// searchUsers finds discoverable users by nickname, leaving out
+// disabled accounts.
+func searchUsers(keyword string) ([]UserSearchEntry, error) {
+	if strings.TrimSpace(keyword) == "" {
+		return nil, nil
+	}
+	var users []model.User
+	err := db.
+		Where("LOWER(nickname) LIKE '%' || ? || '%' ESCAPE '\\'", escapeLike(strings.ToLower(keyword))).
+		Where("discoverable").
+		Where("disabled = ?", false).
+		Order("nickname").
+		Limit(50).
+		Find(&users).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]uint, 0, len(users))
+	for _, v := range users {
+		ids = append(ids, v.ID)
+	}
+	var counts []struct {
+		UserID uint
+		Total  int64
+	}
+	err = db.Model(&model.Playlist{}).
+		Select("user_id, COUNT(*) AS total").
+		Where("user_id IN ?", ids).
+		Where("is_public").
+		Group("user_id").
+		Find(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	playlists := make(map[uint]int64, len(counts))
+	for _, v := range counts {
+		playlists[v.UserID] = v.Total
+	}
+
+	res := make([]UserSearchEntry, 0, len(users))
+	for _, v := range users {
+		res = append(res, UserSearchEntry{
+			UserIntro:       userIntro(v),
+			PublicPlaylists: playlists[v.ID],
+		})
+	}
+	return res, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike escapes the wildcards of a LIKE pattern, to be used with
+// ESCAPE '\'.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func EndpointSession(ng *gin.Engine) {
+	g := ng.Group("/api/user/sessions", AuthRequired)
+
+	g.GET("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		current := ctx.MustGet("session").(model.Session)
+		var sessions []model.Session
+		if err := db.Where("user_id = ?", user.ID).Order("last_accessed DESC").
+			Find(&sessions).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		res := make([]SessionInfo, 0, len(sessions))
+		for _, v := range sessions {
+			res = append(res, sessionInfo(v, v.ID == current.ID))
+		}
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	g.DELETE("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		current := ctx.MustGet("session").(model.Session)
+		form := DeleteForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed delete form"))
+			return
+		}
+		res := db.Unscoped().Where("id = ? AND user_id = ?", form.ID, user.ID).Delete(&model.Session{})
+		if res.Error != nil {
+			ctx.JSON(http.StatusOK, writeErr(res.Error))
+			return
+		}
+		if res.RowsAffected == 0 {
+			ctx.JSON(http.StatusOK, resErr(NotFound, "session not found"))
+			return
+		}
+		if form.ID == strconv.Itoa(int(current.ID)) {
+			clearSessionCookie(ctx)
+		}
+		audit(ctx, AuditSessionRevoke, user.ID, true, "session "+form.ID)
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.DELETE("/others", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		current := ctx.MustGet("session").(model.Session)
+		if err := db.Unscoped().Where("user_id = ? AND id <> ?", user.ID, current.ID).
+			Delete(&model.Session{}).Error; err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditSessionRevoke, user.ID, true, "all other sessions")
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+}
+
+// createSession starts a new session for user. If the user would exceed
+// the configured session limit, the least recently used sessions are
+// revoked.
+func createSession(ctx *gin.Context, user model.User) (model.Session, error) {
+	session := model.Session{
+		UserID:       user.ID,
+		User:         user,
+		SessionID:    uuid.NewString(),
+		UserAgent:    ctx.Request.UserAgent(),
+		LastAccessed: time.Now(),
+		IP:           ctx.ClientIP(),
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(&session).Error; err != nil {
+			return err
+		}
+		if config.Cfg.MaxSessions <= 0 {
+			return nil
+		}
+		var stale []uint
+		if err := tx.Model(&model.Session{}).Where("user_id = ?", user.ID).
+			Order("last_accessed DESC").Offset(config.Cfg.MaxSessions).
+			Pluck("id", &stale).Error; err != nil {
+			return err
+		}
+		if len(stale) == 0 {
+			return nil
+		}
+		return tx.Unscoped().Where("id IN ?", stale).Delete(&model.Session{}).Error
+	})
+	return session, err
+}
+
+func sessionExpired(s model.Session, now time.Time) bool {
+	if idle := config.Cfg.SessionIdleTimeout; idle > 0 && now.Sub(s.LastAccessed) > idle {
+		return true
+	}
+	if age := config.Cfg.SessionMaxAge; age > 0 && now.Sub(s.CreatedAt) > age {
+		return true
+	}
+	return false
+}
+
+func cookieSameSite() http.SameSite {
+	switch strings.ToLower(config.Cfg.Cookie.SameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	case "lax":
+		return http.SameSiteLaxMode
+	default:
+		return http.SameSiteDefaultMode
+	}
+}
+
+func setSessionCookie(ctx *gin.Context, session model.Session) {
+	cfg := config.Cfg.Cookie
+	ctx.SetSameSite(cookieSameSite())
+	ctx.SetCookie("session", session.SessionID, sessionCookieAge(session), cfg.Path, cfg.Domain, cfg.Secure, true)
+}
+
+func clearSessionCookie(ctx *gin.Context) {
+	cfg := config.Cfg.Cookie
+	ctx.SetSameSite(cookieSameSite())
+	ctx.SetCookie("session", "", -1, cfg.Path, cfg.Domain, cfg.Secure, true)
+}
+
+// sessionCookieAge returns the cookie lifetime in seconds, so that the
+// cookie does not outlive the session on the server side.
+func sessionCookieAge(s model.Session) int {
+	age := 7 * 24 * time.Hour
+	if idle := config.Cfg.SessionIdleTimeout; idle > 0 && idle < age {
+		age = idle
+	}
+	if maxAge := config.Cfg.SessionMaxAge; maxAge > 0 {
+		if remaining := time.Until(s.CreatedAt.Add(maxAge)); remaining < age {
+			age = remaining
+		}
+	}
+	if age < time.Second {
+		return 1
+	}
+	return int(age.Seconds())
+}
+
+// initSessionCleanup periodically purges expired and logged out
+// sessions from the database.
+func initSessionCleanup() {
+	go func() {
+		t := time.NewTicker(time.Hour)
+		for {
+			purgeSessions(time.Now())
+			<-t.C
+		}
+	}()
+}
+
+func purgeSessions(now time.Time) {
+	q := db.Unscoped().Where("deleted_at IS NOT NULL")
+	if idle := config.Cfg.SessionIdleTimeout; idle > 0 {
+		q = q.Or("last_accessed < ?", now.Add(-idle))
+	}
+	if age := config.Cfg.SessionMaxAge; age > 0 {
+		q = q.Or("created_at < ?", now.Add(-age))
+	}
+	res := q.Delete(&model.Session{})
+	if res.Error != nil {
+		log.Printf("Failed to purge sessions: %v\n", res.Error)
+		return
+	}
+	if res.RowsAffected != 0 {
+		log.Printf("Purged %d expired sessions.\n", res.RowsAffected)
+	}
+}
@@ -124,7 +124,9 @@ func EndpointShare(ng *gin.Engine) {
 		}
 		if err := db.Unscoped().Delete(&share).Error; err != nil {
 			ctx.JSON(http.StatusOK, writeErr(err))
+			return
 		}
+		audit(ctx, AuditShareDelete, user.ID, true, share.ShareID)
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 
@@ -172,6 +174,7 @@ func EndpointShare(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		audit(ctx, AuditShareCreate, user.ID, true, share.ShareID)
 		ctx.JSON(http.StatusOK, resOk(share.ShareID))
 	})
 }
@@ -100,6 +100,7 @@ func EndpointToken(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		audit(ctx, AuditTokenCreate, user.ID, true, token.Name+" "+token.URL)
 		ctx.JSON(http.StatusOK, resOk(tokenResponse(token)))
 	})
 
@@ -139,6 +140,7 @@ func EndpointToken(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		audit(ctx, AuditTokenUpdate, user.ID, true, token.Name+" "+token.URL)
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 
@@ -166,6 +168,7 @@ func EndpointToken(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		audit(ctx, AuditTokenDelete, user.ID, true, token.Name+" "+token.URL)
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 }
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"gorm.io/gorm"
+)
+
+// Only one run over all users at a time, the background job and admins
+// would otherwise sign the same tokens twice.
+var tokenRenewalMu sync.Mutex
+
+// Locks the tokens of a single user, which are also renewed on demand.
+var userRenewalMu = struct {
+	sync.Mutex
+	m map[uint]*sync.Mutex
+}{m: make(map[uint]*sync.Mutex)}
+
+func userRenewalLock(userID uint) *sync.Mutex {
+	userRenewalMu.Lock()
+	defer userRenewalMu.Unlock()
+	mu, ok := userRenewalMu.m[userID]
+	if !ok {
+		mu = &sync.Mutex{}
+		userRenewalMu.m[userID] = mu
+	}
+	return mu
+}
+
+// Every renewal asks annil to sign tokens, so users can't trigger it
+// more often than this.
+const tokenRenewCooldown = 10 * time.Minute
+
+var tokenRenewLimiter = newCooldown()
+
+func EndpointTokenRenewal(ng *gin.Engine) {
+	ng.POST("/api/credential/renew", AuthRequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := TokenRenewForm{}
+		if ctx.Request.ContentLength != 0 {
+			if err := ctx.ShouldBind(&form); err != nil {
+				ctx.JSON(http.StatusOK, illegalParams("malformed renew form"))
+				return
+			}
+		}
+		if d := tokenRenewLimiter.take(tokenRenewCooldown, strconv.Itoa(int(user.ID))); d > 0 {
+			ctx.JSON(http.StatusOK, attemptLimited(RenewalLimited, d))
+			return
+		}
+		res, err := renewUserTokens(user, form.Force, time.Now())
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditTokenRenew, user.ID, res.Failed == 0, renewalDetail(res))
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	ng.POST("/api/admin/credential/renew", AuthRequired, AdminRequired, func(ctx *gin.Context) {
+		form := AdminTokenRenewForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed renew form"))
+			return
+		}
+		if form.UserID == "" {
+			res, err := renewAllTokens(form.Force, time.Now())
+			if err != nil {
+				ctx.JSON(http.StatusOK, readErr(err))
+				return
+			}
+			audit(ctx, AuditTokenRenew, 0, res.Failed == 0, "all users, "+renewalDetail(res))
+			ctx.JSON(http.StatusOK, resOk(res))
+			return
+		}
+		user, ok := findAdminTarget(ctx, form.UserID)
+		if !ok {
+			return
+		}
+		res, err := renewUserTokens(user, form.Force, time.Now())
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditTokenRenew, user.ID, res.Failed == 0, renewalDetail(res))
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+}
+
+func renewalDetail(res TokenRenewalResult) string {
+	return strconv.Itoa(res.Renewed) + " renewed, " + strconv.Itoa(res.Failed) + " failed"
+}
+
+// initTokenRenewal periodically re-signs controlled tokens that are
+// about to expire or no longer match their annil configuration.
+func initTokenRenewal() {
+	c := config.Cfg.TokenRenewal
+	if !c.Enabled || c.Interval <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(c.Interval)
+		for {
+			res, err := renewAllTokens(false, time.Now())
+			if err != nil {
+				log.Printf("Failed to renew annil tokens: %v\n", err)
+			} else if res.Renewed != 0 || res.Failed != 0 {
+				log.Printf("Renewed %d annil tokens, %d failed.\n", res.Renewed, res.Failed)
+			}
+			<-t.C
+		}
+	}()
+}
+
+func renewAllTokens(force bool, now time.Time) (TokenRenewalResult, error) {
+	tokenRenewalMu.Lock()
+	defer tokenRenewalMu.Unlock()
+	total := TokenRenewalResult{}
+	if len(enabledAnnils()) == 0 {
+		return total, nil
+	}
+	var users []model.User
+	if err := db.Find(&users).Error; err != nil {
+		return total, err
+	}
+	for _, user := range users {
+		res, err := renewUserTokens(user, force, now)
+		if err != nil {
+			return total, err
+		}
+		total.Renewed += res.Renewed
+		total.Failed += res.Failed
+	}
+	return total, nil
+}
+
+func enabledAnnils() []config.AnnilToken {
+	var res []config.AnnilToken
+	for _, v := range config.Cfg.AnnilToken {
+		if v.Enabled {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// renewUserTokens re-signs the controlled tokens of user that need it
+// and signs tokens for enabled annil servers the user has none for.
+// With force every controlled token is re-signed, which is needed after
+// an annil server rotated its keys since anniv can't verify signatures.
+// Failing to sign a token is counted and doesn't stop the others.
+func renewUserTokens(user model.User, force bool, now time.Time) (TokenRenewalResult, error) {
+	res := TokenRenewalResult{}
+	annils := enabledAnnils()
+	if len(annils) == 0 {
+		return res, nil
+	}
+	mu := userRenewalLock(user.ID)
+	mu.Lock()
+	defer mu.Unlock()
+	var tokens []model.Token
+	if err := db.Where("user_id = ? AND controlled", user.ID).Find(&tokens).Error; err != nil {
+		return res, err
+	}
+	for _, annil := range annils {
+		found := false
+		for _, t := range tokens {
+			if t.URL != annil.URL {
+				continue
+			}
+			found = true
+			reason := "forced"
+			if !force {
+				reason = tokenRenewalReason(t.Token, annil, user.Email, now)
+			}
+			if reason == "" {
+				continue
+			}
+			signed, err := signAnnilToken(annil, user.Email)
+			if err != nil {
+				log.Printf("Failed to renew token %s of user %d (%s): %v\n", t.TokenID, user.ID, reason, err)
+				res.Failed++
+				continue
+			}
+			t.Token = signed
+			if err := db.Save(&t).Error; err != nil {
+				return res, err
+			}
+			res.Renewed++
+		}
+		if found {
+			continue
+		}
+		signed, err := signAnnilToken(annil, user.Email)
+		if err != nil {
+			log.Printf("Failed to sign %s token for user %d: %v\n", annil.Name, user.ID, err)
+			res.Failed++
+			continue
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return createControlledTokens(tx, user.ID, []Token{{
+				Name:  annil.Name,
+				URL:   annil.URL,
+				Token: signed,
+			}})
+		})
+		if err != nil {
+			return res, err
+		}
+		res.Renewed++
+	}
+	return res, nil
+}
+
+// tokenRenewalReason inspects the claims of a controlled token and
+// tells why it has to be re-signed, or returns an empty string if it
+// is still good.
+func tokenRenewalReason(token string, annil config.AnnilToken, email string, now time.Time) string {
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, &AnnilUserClaims{})
+	if err != nil {
+		return "malformed"
+	}
+	claims := parsed.Claims.(*AnnilUserClaims)
+	switch {
+	case claims.Type != "user":
+		return "wrong type"
+	case claims.UserID != email:
+		return "wrong user"
+	case (claims.Share != nil) != annil.AllowShare:
+		return "share permission changed"
+	case claims.ExpiresAt != nil && claims.ExpiresAt.Before(now.Add(config.Cfg.TokenRenewal.RenewBefore)):
+		return "expiring"
+	}
+	return ""
+}
+
+// migrateAllTokens drops tokens from before tokens were marked as
+// controlled and controlled tokens of annil servers that are no longer
+// enabled, then re-signs every controlled token. Failing to sign any of
+// them is an error.
+func migrateAllTokens() error {
+	err := db.Unscoped().Where("controlled IS NULL").Delete(&model.Token{}).Error
+	if err != nil {
+		return err
+	}
+	var urls []string
+	for _, v := range enabledAnnils() {
+		urls = append(urls, v.URL)
+	}
+	stale := db.Unscoped().Where("controlled")
+	if len(urls) != 0 {
+		stale = stale.Where("url NOT IN ?", urls)
+	}
+	if err := stale.Delete(&model.Token{}).Error; err != nil {
+		return err
+	}
+	res, err := renewAllTokens(true, time.Now())
+	if err != nil {
+		return err
+	}
+	log.Printf("Renewed %d annil tokens, %d failed.\n", res.Renewed, res.Failed)
+	if res.Failed != 0 {
+		return errors.New("failed to renew " + strconv.Itoa(res.Failed) + " annil tokens")
+	}
+	return nil
+}
@@ -1,11 +1,16 @@
 package services
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
+	"strings"
 
 	"github.com/ProjectAnni/anniv-go/model"
 	"github.com/gin-gonic/gin"
 	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
 )
 
 func Endpoint2FA(ng *gin.Engine) {
@@ -27,16 +32,27 @@ func Endpoint2FA(ng *gin.Engine) {
 			return
 		}
 		if !totp.Validate(form.Code, form.Secret) {
+			audit(ctx, AuditTFAEnable, user.ID, false, "wrong 2fa code")
 			ctx.JSON(http.StatusOK, wrong2FACode())
 			return
 		}
 		user.Enable2FA = true
 		user.Secret = form.Secret
-		if err := db.Save(&user).Error; err != nil {
+		var codes []string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&user).Error; err != nil {
+				return err
+			}
+			var err error
+			codes, err = resetRecoveryCodes(tx, user.ID)
+			return err
+		})
+		if err != nil {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
-		ctx.JSON(http.StatusOK, resOk(nil))
+		audit(ctx, AuditTFAEnable, user.ID, true, "")
+		ctx.JSON(http.StatusOK, resOk(RecoveryCodesInfo{Codes: codes, Remaining: len(codes)}))
 	})
 
 	g.DELETE("", TFARequired, func(ctx *gin.Context) {
@@ -51,10 +67,136 @@ func Endpoint2FA(ng *gin.Engine) {
 		}
 		user.Enable2FA = false
 		user.Secret = ""
-		if err := db.Save(&user).Error; err != nil {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Save(&user).Error; err != nil {
+				return err
+			}
+			if hasWebAuthn(user.ID) {
+				// recovery codes still cover the passkeys
+				return nil
+			}
+			return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&model.RecoveryCode{}).Error
+		})
+		if err != nil {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		audit(ctx, AuditTFADisable, user.ID, true, "")
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
+
+	g.GET("/recovery", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		var count int64
+		if err := db.Model(&model.RecoveryCode{}).Where("user_id = ?", user.ID).
+			Count(&count).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(RecoveryCodesInfo{Remaining: int(count)}))
+	})
+
+	// Replaces all recovery codes of the user with a new set
+	g.POST("/recovery", TFARequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		if !has2FA(user) {
+			ctx.JSON(http.StatusOK, Response{
+				Status:  TFANotEnabled,
+				Message: "2fa is not enabled",
+				Data:    nil,
+			})
+			return
+		}
+		var codes []string
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			codes, err = resetRecoveryCodes(tx, user.ID)
+			return err
+		})
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditRecoveryReset, user.ID, true, "")
+		ctx.JSON(http.StatusOK, resOk(RecoveryCodesInfo{Codes: codes, Remaining: len(codes)}))
+	})
+}
+
+// has2FA reports whether user has set up any second factor. Passkeys
+// can't be verified while webauthn is disabled, then they only count
+// if the user has recovery codes left to use instead. Otherwise the
+// user would be locked out of every endpoint requiring 2FA.
+func has2FA(user model.User) bool {
+	if user.Enable2FA {
+		return true
+	}
+	if !hasWebAuthn(user.ID) {
+		return false
+	}
+	return webAuthn != nil || hasRecoveryCodes(user.ID)
+}
+
+func hasRecoveryCodes(userID uint) bool {
+	var count int64
+	db.Model(&model.RecoveryCode{}).Where("user_id = ?", userID).Count(&count)
+	return count != 0
+}
+
+// verifySecondFactor checks a TOTP code, a recovery code or a WebAuthn
+// assertion against the second factors of user. It always passes for
+// users without any second factor.
+func verifySecondFactor(user model.User, code string, assertion *WebAuthnAssertionForm) bool {
+	if assertion != nil && webAuthn != nil {
+		_, _, err := finishWebAuthnAssertion(*assertion, user.ID)
+		return err == nil
+	}
+	if user.Enable2FA && totp.Validate(code, user.Secret) {
+		return true
+	}
+	if code != "" && useRecoveryCode(user.ID, code) {
+		return true
+	}
+	return !has2FA(user)
+}
+
+const recoveryCodeCount = 10
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// resetRecoveryCodes replaces the recovery codes of a user and returns
+// the new ones. Only their hashes are stored, so this is the only time
+// they can be shown.
+func resetRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]model.RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		records = append(records, model.RecoveryCode{UserID: userID, Hash: hashRecoveryCode(code)})
+	}
+	return codes, tx.Create(&records).Error
+}
+
+// useRecoveryCode consumes a recovery code of the user, reporting
+// whether it was valid.
+func useRecoveryCode(userID uint, code string) bool {
+	res := db.Unscoped().Where("user_id = ? AND hash = ?", userID, hashRecoveryCode(code)).
+		Delete(&model.RecoveryCode{})
+	return res.Error == nil && res.RowsAffected != 0
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
@@ -16,7 +17,6 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/pquerna/otp/totp"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
@@ -27,13 +27,20 @@ func EndpointUser(ng *gin.Engine) {
 	g := ng.Group("/api/user")
 
 	g.POST("/register", func(ctx *gin.Context) {
+		if config.Cfg.DisablePasswordLogin {
+			ctx.JSON(http.StatusOK, passwordLoginDisabled())
+			return
+		}
 		form := RegisterForm{}
 		if err := ctx.ShouldBind(&form); err != nil {
 			ctx.JSON(http.StatusOK, illegalParams("malformed register form"))
 			return
 		}
+		var invite *model.Invite
 		if config.Cfg.RequireInvite {
-			if form.InviteCode != config.Cfg.InviteCode {
+			var ok bool
+			invite, ok = findInvite(form.InviteCode)
+			if !ok {
 				ctx.JSON(http.StatusOK, resErr(InvalidInviteCode, "invalid invite code"))
 				return
 			}
@@ -63,89 +70,124 @@ func EndpointUser(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, wrong2FACode())
 			return
 		}
-		// TODO avatar check
-		hash, err := bcrypt.GenerateFromPassword([]byte(form.Password), bcrypt.DefaultCost)
+		if msg := checkPasswordPolicy(form.Password); msg != "" {
+			ctx.JSON(http.StatusOK, weakPassword(msg))
+			return
+		}
+		hash, err := hashPassword(form.Password)
 		if err != nil {
 			ctx.JSON(http.StatusOK, resErr(InternalError, "error hashing password"))
 			return
 		}
 		user := model.User{
-			Password:  string(hash),
+			Password:  hash,
 			Email:     form.Email,
 			Nickname:  form.Nickname,
-			Avatar:    form.Avatar,
 			Enable2FA: form.Secret != "",
 			Secret:    form.Secret,
+			// without a mail server there is no way to verify
+			EmailVerified: !mailEnabled(),
 		}
 		tokens, err := signUserTokens(form.Email)
 		if err != nil {
 			ctx.JSON(http.StatusOK, resErr(InternalError, "failed to sign default tokens: "+err.Error()))
 			return
 		}
+		var recoveryCodes []string
 		err = db.Transaction(func(tx *gorm.DB) error {
-			err := tx.Create(&user).Error
+			if invite != nil {
+				if err := consumeInvite(tx, invite, &user); err != nil {
+					return err
+				}
+			}
+			err := createUser(tx, &user, tokens)
 			if err != nil {
 				return err
 			}
-			for _, v := range tokens {
-				t := model.Token{
-					TokenID:    uuid.NewString(),
-					Name:       v.Name,
-					URL:        v.URL,
-					Token:      v.Token,
-					Priority:   v.Priority,
-					UserID:     user.ID,
-					Controlled: true,
-				}
-				err = tx.Create(&t).Error
-				if err != nil {
-					return err
-				}
+			if user.Enable2FA {
+				recoveryCodes, err = resetRecoveryCodes(tx, user.ID)
+				return err
 			}
 			return nil
 		})
-		if err != nil {
+		if err == errInviteUsedUp {
+			ctx.JSON(http.StatusOK, resErr(InvalidInviteCode, "invalid invite code"))
+			return
+		} else if err != nil {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		audit(ctx, AuditRegister, user.ID, true, "")
+		if mailEnabled() {
+			sendVerificationMail(user)
+		}
+		if user.Enable2FA {
+			ctx.JSON(http.StatusOK, resOk(RecoveryCodesInfo{Codes: recoveryCodes, Remaining: len(recoveryCodes)}))
+			return
+		}
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 
 	g.POST("/login", func(ctx *gin.Context) {
+		if config.Cfg.DisablePasswordLogin {
+			ctx.JSON(http.StatusOK, passwordLoginDisabled())
+			return
+		}
 		form := LoginForm{}
 		err := ctx.ShouldBind(&form)
 		if err != nil {
 			ctx.JSON(http.StatusOK, illegalParams("malformed login form"))
 			return
 		}
+		ipKey, accountKey := ipLimitKey(ctx.ClientIP()), accountLimitKey(form.Email)
+		if d := authLimiter.locked(ipKey, accountKey); d > 0 {
+			audit(ctx, AuditLogin, 0, false, "attempt limited for "+form.Email)
+			ctx.JSON(http.StatusOK, attemptLimited(LoginAttemptLimited, d))
+			return
+		}
+		loginFailed := func() {
+			authLimiter.fail(ipKey, config.Cfg.LoginLimit.IPAttempts)
+			authLimiter.fail(accountKey, config.Cfg.LoginLimit.AccountAttempts)
+		}
 		user := model.User{}
 		if db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)}).
 			Where("email = ?", form.Email).First(&user).RowsAffected == 0 {
+			loginFailed()
+			audit(ctx, AuditLogin, 0, false, "unknown email "+form.Email)
 			ctx.JSON(http.StatusOK, userNotFound())
 			return
 		}
-		err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(form.Password))
-		if err != nil {
+		if !verifyPassword(user.Password, form.Password) {
+			loginFailed()
+			audit(ctx, AuditLogin, user.ID, false, "wrong password")
 			ctx.JSON(http.StatusOK, wrongPassword())
 			return
 		}
-		if user.Enable2FA && !totp.Validate(form.Code, user.Secret) {
-			ctx.JSON(http.StatusOK, wrong2FACode())
+		if user.Disabled {
+			audit(ctx, AuditLogin, user.ID, false, "account disabled")
+			ctx.JSON(http.StatusOK, userDisabled())
 			return
 		}
-		session := model.Session{
-			UserID:       user.ID,
-			User:         user,
-			SessionID:    uuid.NewString(),
-			UserAgent:    ctx.Request.UserAgent(),
-			LastAccessed: time.Now(),
-			IP:           ctx.ClientIP(),
+		if emailVerificationRequired() && !user.EmailVerified {
+			audit(ctx, AuditLogin, user.ID, false, "email not verified")
+			ctx.JSON(http.StatusOK, resErr(EmailNotVerified, "email not verified"))
+			return
+		}
+		if !verifySecondFactor(user, form.Code, form.WebAuthn) {
+			loginFailed()
+			audit(ctx, AuditLogin, user.ID, false, "wrong second factor")
+			ctx.JSON(http.StatusOK, wrong2FACode())
+			return
 		}
-		if err = db.Save(&session).Error; err != nil {
+		authLimiter.reset(accountKey)
+		rehashPassword(&user, form.Password)
+		session, err := createSession(ctx, user)
+		if err != nil {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
-		ctx.SetCookie("session", session.SessionID, 86400, "/", "", false, true)
+		audit(ctx, AuditLogin, user.ID, true, "password")
+		setSessionCookie(ctx, session)
 		ctx.JSON(http.StatusOK, resOk(userInfo(user)))
 	})
 
@@ -155,19 +197,53 @@ func EndpointUser(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
-		ctx.SetCookie("session", "", -1, "", "", false, true)
+		audit(ctx, AuditLogout, session.UserID, true, "")
+		clearSessionCookie(ctx)
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 
 	g.POST("/revoke", AuthRequired, TFARequired, func(ctx *gin.Context) {
 		user := ctx.MustGet("user").(model.User)
-		if err := db.Delete(&user).Error; err != nil {
+		form := RevokeForm{}
+		if err := ctx.ShouldBind(&form); err != nil && err != io.EOF {
+			ctx.JSON(http.StatusOK, illegalParams("malformed revoke form"))
+			return
+		}
+		heir, ok := lyricHeir(ctx, user, form)
+		if !ok {
+			return
+		}
+		var playlists []uint
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var err error
+			playlists, err = deleteUserData(tx, user, heir)
+			return err
+		})
+		if err != nil {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		for _, v := range playlists {
+			unindexPlaylist(v)
+		}
+		removeAvatar(user.Avatar)
+		audit(ctx, AuditAccountDelete, user.ID, true, "")
+		clearSessionCookie(ctx)
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 
+	g.GET("/export", AuthRequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		buf, err := exportUserData(user)
+		if err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		name := fmt.Sprintf("anniv-export-%d-%s.zip", user.ID, time.Now().Format("20060102"))
+		ctx.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+		ctx.Data(http.StatusOK, "application/zip", buf)
+	})
+
 	g.GET("/info", AuthRequired, func(ctx *gin.Context) {
 		user := ctx.MustGet("user").(model.User)
 		ctx.JSON(http.StatusOK, resOk(userInfo(user)))
@@ -195,16 +271,19 @@ func EndpointUser(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, illegalParams("malformed password form"))
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(form.OldPassword)); err != nil {
-			ctx.JSON(http.StatusOK, wrongPassword())
+		if !confirmIdentity(ctx, user, form.OldPassword, AuditPasswordChange) {
 			return
 		}
-		hash, err := bcrypt.GenerateFromPassword([]byte(form.NewPassword), bcrypt.DefaultCost)
+		if msg := checkPasswordPolicy(form.NewPassword); msg != "" {
+			ctx.JSON(http.StatusOK, weakPassword(msg))
+			return
+		}
+		hash, err := hashPassword(form.NewPassword)
 		if err != nil {
 			ctx.JSON(http.StatusOK, illegalParams("failed to hash password"))
 			return
 		}
-		user.Password = string(hash)
+		user.Password = hash
 		err = db.Transaction(func(tx *gorm.DB) error {
 			err := tx.Save(&user).Error
 			if err != nil {
@@ -216,6 +295,167 @@ func EndpointUser(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		audit(ctx, AuditPasswordChange, user.ID, true, "")
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.POST("/email/verify", func(ctx *gin.Context) {
+		form := TokenForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed token form"))
+			return
+		}
+		user, _, err := parseActionToken(ActionVerifyEmail, form.Token)
+		if err != nil {
+			ctx.JSON(http.StatusOK, invalidToken())
+			return
+		}
+		if err := db.Model(user).Update("email_verified", true).Error; err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditEmailVerify, user.ID, true, user.Email)
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	// Starts changing the email address. With mail enabled the change only
+	// takes effect once confirmed through the link sent to the new address.
+	g.POST("/email", AuthRequired, TFARequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := ChangeEmailForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed email form"))
+			return
+		}
+		if !confirmIdentity(ctx, user, form.Password, AuditEmailChange) {
+			return
+		}
+		if !emailReg.MatchString(form.Email) {
+			ctx.JSON(http.StatusOK, illegalEmail("invalid email"))
+			return
+		}
+		if form.Email == user.Email || emailTaken(form.Email) {
+			ctx.JSON(http.StatusOK, illegalEmail("email already taken"))
+			return
+		}
+		if !mailEnabled() {
+			// without a mail server there is no way to verify
+			if status, err := changeEmail(ctx, user, form.Email); err != nil {
+				ctx.JSON(http.StatusOK, resErr(status, err.Error()))
+				return
+			}
+			ctx.JSON(http.StatusOK, resOk(nil))
+			return
+		}
+		claims := newActionClaims(ActionChangeEmail, user, changeEmailTTL)
+		claims.NewEmail = form.Email
+		token, err := signActionClaims(claims)
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(InternalError, err.Error()))
+			return
+		}
+		sendMailAsync(form.Email, "change_email", MailData{
+			Nickname:  user.Nickname,
+			Email:     form.Email,
+			Link:      actionLink("/change-email", token),
+			ExpiresIn: "24 hours",
+		})
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.POST("/email/confirm", func(ctx *gin.Context) {
+		form := TokenForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed token form"))
+			return
+		}
+		user, claims, err := parseActionToken(ActionChangeEmail, form.Token)
+		if err != nil || claims.NewEmail == "" {
+			ctx.JSON(http.StatusOK, invalidToken())
+			return
+		}
+		if emailTaken(claims.NewEmail) {
+			ctx.JSON(http.StatusOK, illegalEmail("email already taken"))
+			return
+		}
+		if status, err := changeEmail(ctx, *user, claims.NewEmail); err != nil {
+			ctx.JSON(http.StatusOK, resErr(status, err.Error()))
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	// Responds with success whether the address is registered or not,
+	// so that it can't be used to probe for accounts.
+	g.POST("/email/verify/resend", func(ctx *gin.Context) {
+		form := EmailForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed email form"))
+			return
+		}
+		if !mailAllowed(ctx, form.Email) {
+			return
+		}
+		user := model.User{}
+		if mailEnabled() && db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)}).
+			Where("email = ?", form.Email).First(&user).RowsAffected != 0 && !user.EmailVerified {
+			sendVerificationMail(user)
+		}
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.POST("/password/forgot", func(ctx *gin.Context) {
+		form := EmailForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed email form"))
+			return
+		}
+		if !mailAllowed(ctx, form.Email) {
+			return
+		}
+		user := model.User{}
+		if mailEnabled() && db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)}).
+			Where("email = ?", form.Email).First(&user).RowsAffected != 0 && !user.Disabled {
+			sendResetPasswordMail(user)
+		}
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.POST("/password/reset", func(ctx *gin.Context) {
+		form := ResetPasswordForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed reset form"))
+			return
+		}
+		user, _, err := parseActionToken(ActionResetPassword, form.Token)
+		if err != nil {
+			ctx.JSON(http.StatusOK, invalidToken())
+			return
+		}
+		if msg := checkPasswordPolicy(form.NewPassword); msg != "" {
+			ctx.JSON(http.StatusOK, weakPassword(msg))
+			return
+		}
+		hash, err := hashPassword(form.NewPassword)
+		if err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("failed to hash password"))
+			return
+		}
+		user.Password = hash
+		// receiving the mail proves ownership of the address as well
+		user.EmailVerified = true
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Save(user).Error
+			if err != nil {
+				return err
+			}
+			return tx.Where("user_id=?", user.ID).Unscoped().Delete(&model.Session{}).Error
+		})
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditPasswordReset, user.ID, true, "")
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 
@@ -230,12 +470,24 @@ func EndpointUser(ng *gin.Engine) {
 			ctx.JSON(http.StatusOK, resErr(InvalidNickname, "nickname too long"))
 			return
 		}
+		// Avatars can only be uploaded, so the form may just keep or clear it
+		if form.Avatar != "" && form.Avatar != localAvatar(user.Avatar) {
+			ctx.JSON(http.StatusOK, resErr(InvalidAvatar, "avatar must be uploaded"))
+			return
+		}
+		previousAvatar := user.Avatar
 		user.Nickname = form.Nickname
 		user.Avatar = form.Avatar
+		if form.Discoverable != nil {
+			user.Discoverable = *form.Discoverable
+		}
 		if err := db.Save(&user).Error; err != nil {
 			ctx.JSON(http.StatusOK, writeErr(err))
 			return
 		}
+		if user.Avatar == "" {
+			removeAvatar(previousAvatar)
+		}
 		ctx.JSON(http.StatusOK, resOk(nil))
 	})
 }
@@ -256,6 +508,30 @@ func userNotFound() Response {
 	}
 }
 
+func userDisabled() Response {
+	return Response{
+		Status:  UserDisabled,
+		Message: "user is disabled",
+		Data:    nil,
+	}
+}
+
+func passwordLoginDisabled() Response {
+	return Response{
+		Status:  PasswordLoginDisabled,
+		Message: "password login is disabled",
+		Data:    nil,
+	}
+}
+
+func invalidToken() Response {
+	return Response{
+		Status:  InvalidToken,
+		Message: "invalid or expired token",
+		Data:    nil,
+	}
+}
+
 func wrongPassword() Response {
 	return Response{
 		Status:  InvalidPassword,
@@ -264,6 +540,110 @@ func wrongPassword() Response {
 	}
 }
 
+const verifyEmailTTL = 24 * time.Hour
+const resetPasswordTTL = time.Hour
+const changeEmailTTL = 24 * time.Hour
+
+func sendVerificationMail(user model.User) {
+	token, err := signActionToken(ActionVerifyEmail, user, verifyEmailTTL)
+	if err != nil {
+		log.Printf("Failed to sign verification token: %v\n", err)
+		return
+	}
+	sendMailAsync(user.Email, "verify_email", MailData{
+		Nickname:  user.Nickname,
+		Email:     user.Email,
+		Link:      actionLink("/verify-email", token),
+		ExpiresIn: "24 hours",
+	})
+}
+
+func sendResetPasswordMail(user model.User) {
+	token, err := signActionToken(ActionResetPassword, user, resetPasswordTTL)
+	if err != nil {
+		log.Printf("Failed to sign reset token: %v\n", err)
+		return
+	}
+	sendMailAsync(user.Email, "reset_password", MailData{
+		Nickname:  user.Nickname,
+		Email:     user.Email,
+		Link:      actionLink("/reset-password", token),
+		ExpiresIn: "1 hour",
+	})
+}
+
+// Users without a password must have signed in this recently to make
+// changes which otherwise require their password.
+const recentLoginWindow = 10 * time.Minute
+
+// confirmIdentity checks the password of user before a sensitive change,
+// responding and auditing action if it doesn't match. Users who only
+// sign in through oidc have no password, instead their session must be
+// fresh, in addition to the second factor checked by TFARequired.
+func confirmIdentity(ctx *gin.Context, user model.User, password, action string) bool {
+	if user.Password != "" {
+		if !verifyPassword(user.Password, password) {
+			audit(ctx, action, user.ID, false, "wrong password")
+			ctx.JSON(http.StatusOK, wrongPassword())
+			return false
+		}
+		return true
+	}
+	v, ok := ctx.Get("session")
+	if !ok || time.Since(v.(model.Session).CreatedAt) > recentLoginWindow {
+		audit(ctx, action, user.ID, false, "no recent login")
+		ctx.JSON(http.StatusOK, resErr(RecentLoginRequired, "sign in again to confirm this change"))
+		return false
+	}
+	return true
+}
+
+func emailTaken(email string) bool {
+	return db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)}).
+		Where("email = ?", email).First(&model.User{}).RowsAffected != 0
+}
+
+// changeEmail moves user to a verified new address, re-signing the
+// controlled tokens for it since annil identifies users by email, and
+// lets the old address know. On failure it returns the status to
+// respond with.
+func changeEmail(ctx *gin.Context, user model.User, email string) (int, error) {
+	tokens, err := signUserTokens(email)
+	if err != nil {
+		return InternalError, errors.New("failed to sign tokens: " + err.Error())
+	}
+	oldEmail := user.Email
+	// The controlled tokens are replaced, which must not interleave with
+	// renewing them
+	mu := userRenewalLock(user.ID)
+	mu.Lock()
+	defer mu.Unlock()
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"email":          email,
+			"email_verified": true,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ? AND controlled", user.ID).
+			Delete(&model.Token{}).Error; err != nil {
+			return err
+		}
+		return createControlledTokens(tx, user.ID, tokens)
+	})
+	if err != nil {
+		return WriteErr, err
+	}
+	audit(ctx, AuditEmailChange, user.ID, true, oldEmail+" -> "+email)
+	if mailEnabled() {
+		sendMailAsync(oldEmail, "email_changed", MailData{
+			Nickname: user.Nickname,
+			Email:    email,
+		})
+	}
+	return StatusOK, nil
+}
+
 var client = &http.Client{Timeout: time.Second * 10}
 
 func signUserTokens(user string) ([]Token, error) {
@@ -272,47 +652,180 @@ func signUserTokens(user string) ([]Token, error) {
 		if !v.Enabled {
 			continue
 		}
-		payload := map[string]interface{}{
-			"user_id": user,
-			"share":   v.AllowShare,
-		}
-		b, err := json.Marshal(payload)
+		token, err := signAnnilToken(v, user)
 		if err != nil {
 			return nil, err
 		}
-		baseUrl := v.AdminBaseURL
-		if baseUrl == "" {
-			baseUrl = v.URL
+		res = append(res, Token{
+			Name:     v.Name,
+			URL:      v.URL,
+			Token:    token,
+			Priority: 0,
+		})
+	}
+	return res, nil
+}
+
+// signAnnilToken asks an annil server to sign a user token for the
+// given email.
+func signAnnilToken(annil config.AnnilToken, user string) (string, error) {
+	payload := map[string]interface{}{
+		"user_id": user,
+		"share":   annil.AllowShare,
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	baseUrl := annil.AdminBaseURL
+	if baseUrl == "" {
+		baseUrl = annil.URL
+	}
+	req, err := http.NewRequest(http.MethodPost, baseUrl+"/admin/sign", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", annil.Credential)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("Failed to sign default tokens: response code %d\n", resp.StatusCode)
+		b, _ := io.ReadAll(resp.Body)
+		log.Println(string(b))
+		return "", errors.New("invalid response code")
+	}
+	tokenBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(tokenBytes), nil
+}
+
+// createUser saves a new user together with the controlled tokens
+// signed for them.
+func createUser(tx *gorm.DB, user *model.User, tokens []Token) error {
+	if err := tx.Create(user).Error; err != nil {
+		return err
+	}
+	return createControlledTokens(tx, user.ID, tokens)
+}
+
+func createControlledTokens(tx *gorm.DB, userID uint, tokens []Token) error {
+	for _, v := range tokens {
+		t := model.Token{
+			TokenID:    uuid.NewString(),
+			Name:       v.Name,
+			URL:        v.URL,
+			Token:      v.Token,
+			Priority:   v.Priority,
+			UserID:     userID,
+			Controlled: true,
+		}
+		if err := tx.Create(&t).Error; err != nil {
+			return err
 		}
-		req, err := http.NewRequest(http.MethodPost, baseUrl+"/admin/sign", bytes.NewReader(b))
-		req.Header.Set("Authorization", v.Credential)
-		req.Header.Set("Content-Type", "application/json")
+	}
+	return nil
+}
+
+// lyricHeir resolves who takes over the lyrics of a user about to be
+// deleted, nil meaning they are anonymized. It responds with an error
+// if the form is invalid.
+func lyricHeir(ctx *gin.Context, user model.User, form RevokeForm) (*uint, bool) {
+	switch form.Lyrics {
+	case "", LyricsAnonymize:
+		return nil, true
+	case LyricsReassign:
+	default:
+		ctx.JSON(http.StatusOK, illegalParams("unknown lyric disposal "+form.Lyrics))
+		return nil, false
+	}
+	uid, err := strconv.Atoi(form.ReassignTo)
+	heir := model.User{}
+	if err != nil || uint(uid) == user.ID || db.Where("id = ?", uid).First(&heir).Error != nil {
+		ctx.JSON(http.StatusOK, userNotFound())
+		return nil, false
+	}
+	return &heir.ID, true
+}
+
+// purgeDeletedUsers finishes deleting users that were only soft deleted
+// by earlier versions, so their data is gone and their emails can be
+// registered again.
+func purgeDeletedUsers() error {
+	var users []model.User
+	if err := db.Unscoped().Where("deleted_at IS NOT NULL").Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := deleteUserData(tx, user, nil)
+			return err
+		})
 		if err != nil {
-			return nil, err
+			return err
 		}
-		resp, err := client.Do(req)
-		if err != nil {
+		removeAvatar(user.Avatar)
+	}
+	if len(users) != 0 {
+		log.Printf("Purged %d deleted users.\n", len(users))
+	}
+	return nil
+}
+
+// deleteUserData permanently removes a user together with everything
+// they own. Lyrics are shared with other users, so they are kept and
+// handed over to heir, or anonymized if it is nil. It returns the ids
+// of the removed playlists.
+func deleteUserData(tx *gorm.DB, user model.User, heir *uint) ([]uint, error) {
+	// Soft deleted rows are included, they would otherwise outlive the user
+	var playlists []uint
+	if err := tx.Unscoped().Model(&model.Playlist{}).Where("user_id = ?", user.ID).
+		Pluck("id", &playlists).Error; err != nil {
+		return nil, err
+	}
+	if len(playlists) != 0 {
+		if err := tx.Unscoped().Where("playlist_id IN ?", playlists).
+			Delete(&model.PlaylistSong{}).Error; err != nil {
 			return nil, err
 		}
-		if resp.StatusCode != 200 {
-			log.Printf("Failed to sign default tokens: response code %d\n", resp.StatusCode)
-			b, _ := io.ReadAll(resp.Body)
-			log.Println(string(b))
-			return nil, errors.New("invalid response code")
+		if err := tx.Unscoped().Where("playlist_id IN ?", playlists).
+			Delete(&model.FavoritePlaylist{}).Error; err != nil {
+			return nil, err
 		}
-
-		tokenBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
+	}
+	for _, v := range []interface{}{
+		&model.Playlist{},
+		&model.FavoriteMusic{},
+		&model.FavoritePlaylist{},
+		&model.FavoriteAlbum{},
+		&model.PlayRecord{},
+		&model.Share{},
+		&model.Session{},
+		&model.Token{},
+		&model.WebAuthnCredential{},
+		&model.RecoveryCode{},
+		&model.UserIdentity{},
+		&model.AccessToken{},
+	} {
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(v).Error; err != nil {
 			return nil, err
 		}
-		_ = resp.Body.Close()
-		token := string(tokenBytes)
-		res = append(res, Token{
-			Name:     v.Name,
-			URL:      v.URL,
-			Token:    token,
-			Priority: 0,
-		})
 	}
-	return res, nil
+	if err := tx.Unscoped().Model(&model.Lyric{}).Where("user_id = ?", user.ID).
+		Update("user_id", heir).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Where("creator_id = ?", user.ID).Delete(&model.Invite{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Unscoped().Model(&model.User{}).Where("inviter_id = ?", user.ID).
+		Update("inviter_id", nil).Error; err != nil {
+		return nil, err
+	}
+	return playlists, tx.Unscoped().Delete(&user).Error
 }
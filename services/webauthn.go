@@ -0,0 +1,534 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProjectAnni/anniv-go/config"
+	"github.com/ProjectAnni/anniv-go/model"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const webAuthnCeremonyTTL = 5 * time.Minute
+
+// Pending ceremonies are kept in memory until they expire, so there may
+// only be this many in total and per ip.
+const (
+	webAuthnMaxCeremonies      = 10000
+	webAuthnMaxCeremoniesPerIP = 20
+)
+
+var errWebAuthnFailed = errors.New("webauthn verification failed")
+
+var errTooManyCeremonies = errors.New("too many pending webauthn ceremonies")
+
+var webAuthn *webauthn.WebAuthn
+
+func initWebAuthn() error {
+	cfg := config.Cfg.WebAuthn
+	if !cfg.Enabled {
+		return nil
+	}
+	origins := cfg.RPOrigins
+	if len(origins) == 0 {
+		origins = []string{strings.TrimSuffix(config.Cfg.SiteURL, "/")}
+	}
+	rpID := cfg.RPID
+	if rpID == "" {
+		u, err := url.Parse(config.Cfg.SiteURL)
+		if err != nil {
+			return err
+		}
+		rpID = u.Hostname()
+	}
+	timeout := webauthn.TimeoutConfig{
+		Enforce:    true,
+		Timeout:    webAuthnCeremonyTTL,
+		TimeoutUVD: webAuthnCeremonyTTL,
+	}
+	var err error
+	webAuthn, err = webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: config.Cfg.SiteName,
+		RPOrigins:     origins,
+		Timeouts: webauthn.TimeoutsConfig{
+			Login:        timeout,
+			Registration: timeout,
+		},
+	})
+	return err
+}
+
+func EndpointWebAuthn(ng *gin.Engine) {
+	g := ng.Group("/api/features/webauthn", AuthRequired)
+
+	g.GET("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		var credentials []model.WebAuthnCredential
+		if err := db.Where("user_id = ?", user.ID).Order("created_at").
+			Find(&credentials).Error; err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		res := make([]WebAuthnCredentialInfo, 0, len(credentials))
+		for _, v := range credentials {
+			res = append(res, webAuthnCredentialInfo(v))
+		}
+		ctx.JSON(http.StatusOK, resOk(res))
+	})
+
+	g.POST("/register", TFARequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		wu, err := loadWebAuthnUser(user)
+		if err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		exclusions := make([]protocol.CredentialDescriptor, 0, len(wu.credentials))
+		for _, v := range wu.WebAuthnCredentials() {
+			exclusions = append(exclusions, v.Descriptor())
+		}
+		options, data, err := webAuthn.BeginRegistration(wu,
+			webauthn.WithExclusions(exclusions),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		)
+		if err != nil {
+			ctx.JSON(http.StatusOK, resErr(InternalError, err.Error()))
+			return
+		}
+		id, err := startWebAuthnCeremony(webAuthnCeremony{data: *data, userID: user.ID, register: true, ip: ctx.ClientIP()})
+		if err != nil {
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(WebAuthnCeremonyInfo{CeremonyID: id, Options: options}))
+	})
+
+	g.POST("/register/finish", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := WebAuthnRegisterForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed webauthn form"))
+			return
+		}
+		ceremony, ok := takeWebAuthnCeremony(form.CeremonyID, true)
+		if !ok || ceremony.userID != user.ID {
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(form.Credential))
+		if err != nil {
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		wu, err := loadWebAuthnUser(user)
+		if err != nil {
+			ctx.JSON(http.StatusOK, readErr(err))
+			return
+		}
+		cred, err := webAuthn.CreateCredential(wu, ceremony.data, parsed)
+		if err != nil {
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		if form.Name == "" {
+			form.Name = "Passkey " + strconv.Itoa(len(wu.credentials)+1)
+		}
+		transports := make([]string, 0, len(cred.Transport))
+		for _, v := range cred.Transport {
+			transports = append(transports, string(v))
+		}
+		credential := model.WebAuthnCredential{
+			UserID:          user.ID,
+			Name:            form.Name,
+			CredentialID:    base64.RawURLEncoding.EncodeToString(cred.ID),
+			PublicKey:       cred.PublicKey,
+			AttestationType: cred.AttestationType,
+			Transports:      strings.Join(transports, ","),
+			AAGUID:          cred.Authenticator.AAGUID,
+			SignCount:       cred.Authenticator.SignCount,
+			BackupEligible:  cred.Flags.BackupEligible,
+			BackupState:     cred.Flags.BackupState,
+		}
+		// Recovery codes are what is left if webauthn is ever disabled, so
+		// users starting with a passkey get them as well
+		first := !has2FA(user)
+		var codes []string
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&credential).Error; err != nil {
+				return err
+			}
+			if first {
+				codes, err = resetRecoveryCodes(tx, user.ID)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditPasskeyAdd, user.ID, true, credential.Name)
+		ctx.JSON(http.StatusOK, resOk(WebAuthnRegisterResult{
+			WebAuthnCredentialInfo: webAuthnCredentialInfo(credential),
+			RecoveryCodes:          codes,
+		}))
+	})
+
+	g.PATCH("", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := RenameWebAuthnForm{}
+		if err := ctx.ShouldBind(&form); err != nil || form.Name == "" {
+			ctx.JSON(http.StatusOK, illegalParams("malformed webauthn form"))
+			return
+		}
+		res := db.Model(&model.WebAuthnCredential{}).Where("id = ? AND user_id = ?", form.ID, user.ID).
+			Update("name", form.Name)
+		if res.Error != nil {
+			ctx.JSON(http.StatusOK, writeErr(res.Error))
+			return
+		}
+		if res.RowsAffected == 0 {
+			ctx.JSON(http.StatusOK, resErr(NotFound, "credential not found"))
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	g.DELETE("", TFARequired, func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		form := DeleteForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed delete form"))
+			return
+		}
+		res := db.Unscoped().Where("id = ? AND user_id = ?", form.ID, user.ID).
+			Delete(&model.WebAuthnCredential{})
+		if res.Error != nil {
+			ctx.JSON(http.StatusOK, writeErr(res.Error))
+			return
+		}
+		if res.RowsAffected == 0 {
+			ctx.JSON(http.StatusOK, resErr(NotFound, "credential not found"))
+			return
+		}
+		audit(ctx, AuditPasskeyDelete, user.ID, true, "credential "+form.ID)
+		ctx.JSON(http.StatusOK, resOk(nil))
+	})
+
+	// Starts an assertion which can be passed as second factor to
+	// endpoints requiring 2FA.
+	g.POST("/assert", func(ctx *gin.Context) {
+		user := ctx.MustGet("user").(model.User)
+		info, err := beginWebAuthnAssertion(&user, ctx.ClientIP())
+		if err != nil {
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(info))
+	})
+
+	login := ng.Group("/api/user/login/webauthn")
+
+	// Starts a login. With an email the assertion is bound to that
+	// account and may also be used as second factor of a password
+	// login, otherwise the authenticator picks a discoverable credential.
+	// Unknown addresses and accounts without passkeys get a discoverable
+	// challenge as well, so that this can't be used to probe for accounts.
+	login.POST("", func(ctx *gin.Context) {
+		form := WebAuthnBeginForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed webauthn form"))
+			return
+		}
+		var user *model.User
+		if form.Email != "" {
+			found := model.User{}
+			if db.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)}).
+				Where("email = ?", form.Email).First(&found).RowsAffected != 0 && hasWebAuthn(found.ID) {
+				user = &found
+			}
+		}
+		info, err := beginWebAuthnAssertion(user, ctx.ClientIP())
+		if err != nil {
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		ctx.JSON(http.StatusOK, resOk(info))
+	})
+
+	login.POST("/finish", func(ctx *gin.Context) {
+		form := WebAuthnAssertionForm{}
+		if err := ctx.ShouldBind(&form); err != nil {
+			ctx.JSON(http.StatusOK, illegalParams("malformed webauthn form"))
+			return
+		}
+		ipKey := ipLimitKey(ctx.ClientIP())
+		if d := authLimiter.locked(ipKey); d > 0 {
+			ctx.JSON(http.StatusOK, attemptLimited(LoginAttemptLimited, d))
+			return
+		}
+		user, cred, err := finishWebAuthnAssertion(form, 0)
+		// Passwordless login has to prove both possession and user
+		// verification through the authenticator
+		if err != nil || !cred.Flags.UserVerified {
+			authLimiter.fail(ipKey, config.Cfg.LoginLimit.IPAttempts)
+			// The owner is only known if the assertion itself was valid
+			var userID uint
+			if user != nil {
+				userID = user.ID
+			}
+			audit(ctx, AuditLogin, userID, false, "passkey assertion failed")
+			ctx.JSON(http.StatusOK, webAuthnFailed())
+			return
+		}
+		if user.Disabled {
+			audit(ctx, AuditLogin, user.ID, false, "account disabled")
+			ctx.JSON(http.StatusOK, userDisabled())
+			return
+		}
+		if emailVerificationRequired() && !user.EmailVerified {
+			audit(ctx, AuditLogin, user.ID, false, "email not verified")
+			ctx.JSON(http.StatusOK, resErr(EmailNotVerified, "email not verified"))
+			return
+		}
+		session, err := createSession(ctx, *user)
+		if err != nil {
+			ctx.JSON(http.StatusOK, writeErr(err))
+			return
+		}
+		audit(ctx, AuditLogin, user.ID, true, "passkey")
+		setSessionCookie(ctx, session)
+		ctx.JSON(http.StatusOK, resOk(userInfo(*user)))
+	})
+}
+
+func webAuthnFailed() Response {
+	return Response{
+		Status:  WebAuthnFailed,
+		Message: "webauthn verification failed",
+		Data:    nil,
+	}
+}
+
+// webAuthnUser adapts a user and their credentials to webauthn.User.
+type webAuthnUser struct {
+	user        model.User
+	credentials []model.WebAuthnCredential
+}
+
+func loadWebAuthnUser(user model.User) (*webAuthnUser, error) {
+	res := &webAuthnUser{user: user}
+	err := db.Where("user_id = ?", user.ID).Find(&res.credentials).Error
+	return res, err
+}
+
+func webAuthnUserHandle(id uint) []byte {
+	return []byte(strconv.Itoa(int(id)))
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.user.ID)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.user.Nickname != "" {
+		return u.user.Nickname
+	}
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	res := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, v := range u.credentials {
+		id, err := base64.RawURLEncoding.DecodeString(v.CredentialID)
+		if err != nil {
+			continue
+		}
+		var transports []protocol.AuthenticatorTransport
+		if v.Transports != "" {
+			for _, t := range strings.Split(v.Transports, ",") {
+				transports = append(transports, protocol.AuthenticatorTransport(t))
+			}
+		}
+		res = append(res, webauthn.Credential{
+			ID:              id,
+			PublicKey:       v.PublicKey,
+			AttestationType: v.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: v.BackupEligible,
+				BackupState:    v.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    v.AAGUID,
+				SignCount: v.SignCount,
+			},
+		})
+	}
+	return res
+}
+
+// hasWebAuthn reports whether the user has registered passkeys, even
+// while webauthn is disabled.
+func hasWebAuthn(userID uint) bool {
+	var count int64
+	db.Model(&model.WebAuthnCredential{}).Where("user_id = ?", userID).Count(&count)
+	return count != 0
+}
+
+// webAuthnCeremony holds the state between the begin and finish steps
+// of a registration or assertion.
+type webAuthnCeremony struct {
+	data webauthn.SessionData
+	// 0 for discoverable logins
+	userID   uint
+	register bool
+	// Address of the client that started the ceremony
+	ip      string
+	expires time.Time
+}
+
+var webAuthnCeremonies = struct {
+	sync.Mutex
+	m map[string]webAuthnCeremony
+}{m: make(map[string]webAuthnCeremony)}
+
+func startWebAuthnCeremony(c webAuthnCeremony) (string, error) {
+	webAuthnCeremonies.Lock()
+	defer webAuthnCeremonies.Unlock()
+	now := time.Now()
+	sameIP := 0
+	for k, v := range webAuthnCeremonies.m {
+		if now.After(v.expires) {
+			delete(webAuthnCeremonies.m, k)
+		} else if v.ip == c.ip {
+			sameIP++
+		}
+	}
+	if len(webAuthnCeremonies.m) >= webAuthnMaxCeremonies || sameIP >= webAuthnMaxCeremoniesPerIP {
+		return "", errTooManyCeremonies
+	}
+	id := uuid.NewString()
+	c.expires = now.Add(webAuthnCeremonyTTL)
+	webAuthnCeremonies.m[id] = c
+	return id, nil
+}
+
+// takeWebAuthnCeremony removes and returns a pending ceremony, so that
+// every challenge can only be answered once.
+func takeWebAuthnCeremony(id string, register bool) (webAuthnCeremony, bool) {
+	webAuthnCeremonies.Lock()
+	defer webAuthnCeremonies.Unlock()
+	c, ok := webAuthnCeremonies.m[id]
+	if !ok {
+		return c, false
+	}
+	delete(webAuthnCeremonies.m, id)
+	return c, c.register == register && time.Now().Before(c.expires)
+}
+
+// beginWebAuthnAssertion starts an assertion for user, or a
+// discoverable login if user is nil, on behalf of the client at ip.
+func beginWebAuthnAssertion(user *model.User, ip string) (WebAuthnCeremonyInfo, error) {
+	if user == nil {
+		options, data, err := webAuthn.BeginDiscoverableLogin(
+			webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			return WebAuthnCeremonyInfo{}, err
+		}
+		id, err := startWebAuthnCeremony(webAuthnCeremony{data: *data, ip: ip})
+		if err != nil {
+			return WebAuthnCeremonyInfo{}, err
+		}
+		return WebAuthnCeremonyInfo{CeremonyID: id, Options: options}, nil
+	}
+	wu, err := loadWebAuthnUser(*user)
+	if err != nil {
+		return WebAuthnCeremonyInfo{}, err
+	}
+	options, data, err := webAuthn.BeginLogin(wu)
+	if err != nil {
+		return WebAuthnCeremonyInfo{}, err
+	}
+	id, err := startWebAuthnCeremony(webAuthnCeremony{data: *data, userID: user.ID, ip: ip})
+	if err != nil {
+		return WebAuthnCeremonyInfo{}, err
+	}
+	return WebAuthnCeremonyInfo{CeremonyID: id, Options: options}, nil
+}
+
+// finishWebAuthnAssertion verifies an assertion and updates the stored
+// credential. If userID is not 0, the assertion must have been started
+// for that user.
+func finishWebAuthnAssertion(form WebAuthnAssertionForm, userID uint) (*model.User, *webauthn.Credential, error) {
+	if webAuthn == nil {
+		return nil, nil, errWebAuthnFailed
+	}
+	ceremony, ok := takeWebAuthnCeremony(form.CeremonyID, false)
+	if !ok || (userID != 0 && ceremony.userID != userID) {
+		return nil, nil, errWebAuthnFailed
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(form.Credential))
+	if err != nil {
+		return nil, nil, errWebAuthnFailed
+	}
+
+	var wu *webAuthnUser
+	var cred *webauthn.Credential
+	if ceremony.userID != 0 {
+		user := model.User{}
+		if err := db.Where("id = ?", ceremony.userID).First(&user).Error; err != nil {
+			return nil, nil, errWebAuthnFailed
+		}
+		if wu, err = loadWebAuthnUser(user); err != nil {
+			return nil, nil, err
+		}
+		cred, err = webAuthn.ValidateLogin(wu, ceremony.data, parsed)
+	} else {
+		cred, err = webAuthn.ValidateDiscoverableLogin(func(_, userHandle []byte) (webauthn.User, error) {
+			user := model.User{}
+			if err := db.Where("id = ?", string(userHandle)).First(&user).Error; err != nil {
+				return nil, err
+			}
+			var err error
+			wu, err = loadWebAuthnUser(user)
+			return wu, err
+		}, ceremony.data, parsed)
+	}
+	if err != nil || cred.Authenticator.CloneWarning {
+		return nil, nil, errWebAuthnFailed
+	}
+
+	now := time.Now()
+	if err := db.Model(&model.WebAuthnCredential{}).
+		Where("user_id = ? AND credential_id = ?", wu.user.ID, base64.RawURLEncoding.EncodeToString(cred.ID)).
+		Updates(map[string]interface{}{
+			"sign_count":   cred.Authenticator.SignCount,
+			"backup_state": cred.Flags.BackupState,
+			"last_used":    &now,
+		}).Error; err != nil {
+		return nil, nil, err
+	}
+	return &wu.user, cred, nil
+}